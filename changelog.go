@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Where the changelog is read from
+const (
+	changelogAuto   = "auto"
+	changelogGit    = "git"
+	changelogGitHub = "github"
+)
+
+// commit is one entry of the changelog between the deployed and new sha
+type commit struct {
+	SHA     string `json:"sha"`
+	Subject string `json:"subject"`
+	Author  string `json:"author"`
+}
+
+// ticketKey matches issue tracker keys such as ABC-123
+var ticketKey = regexp.MustCompile(`\b[A-Z][A-Z0-9]+-[0-9]+\b`)
+
+// changelog lists the commits after startSHA up to and including endSHA,
+// newest first, from the local checkout or the GitHub compare API.
+func changelog(startSHA string, endSHA string) ([]commit, error) {
+	switch *changelogSource {
+	case changelogGit:
+		return gitLog(startSHA, endSHA)
+	case changelogGitHub:
+		return githubCompare(startSHA, endSHA)
+	}
+
+	commits, err := gitLog(startSHA, endSHA)
+	if err != nil {
+		return githubCompare(startSHA, endSHA)
+	}
+	return commits, nil
+}
+
+func gitLog(startSHA string, endSHA string) ([]commit, error) {
+	out, err := exec.Command("git", "log", "--format=%h%x1f%s%x1f%an", startSHA+".."+endSHA).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git log %s..%s failed: %v", startSHA, endSHA, err)
+	}
+
+	var commits []commit
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 3 {
+			continue
+		}
+		commits = append(commits, commit{SHA: fields[0], Subject: fields[1], Author: fields[2]})
+	}
+	return commits, nil
+}
+
+func githubCompare(startSHA string, endSHA string) ([]commit, error) {
+	repo, err := detectRepository()
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Commits []struct {
+			SHA    string `json:"sha"`
+			Commit struct {
+				Message string `json:"message"`
+				Author  struct {
+					Name string `json:"name"`
+				} `json:"author"`
+			} `json:"commit"`
+		} `json:"commits"`
+	}
+	if err := githubRequest(repo, "GET", "/compare/"+startSHA+"..."+endSHA, nil, &res); err != nil {
+		return nil, err
+	}
+
+	// the API lists commits oldest first
+	var commits []commit
+	for i := len(res.Commits) - 1; i >= 0; i-- {
+		c := res.Commits[i]
+		sha := c.SHA
+		if len(sha) > 7 {
+			sha = sha[:7]
+		}
+		subject := strings.SplitN(c.Commit.Message, "\n", 2)[0]
+		commits = append(commits, commit{SHA: sha, Subject: subject, Author: c.Commit.Author.Name})
+	}
+	if commits == nil {
+		return nil, errors.New("no commits between " + startSHA + " and " + endSHA)
+	}
+	return commits, nil
+}
+
+// ticketKeys finds the tracker keys mentioned in commit subjects, in the
+// order they first appear.
+func ticketKeys(commits []commit) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, c := range commits {
+		for _, key := range ticketKey.FindAllString(c.Subject, -1) {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// formatChangelog lists the first max commits, and every ticket key, for the
+// notification.
+func formatChangelog(commits []commit, max int) string {
+	var lines []string
+
+	shown := commits
+	if len(shown) > max {
+		shown = shown[:max]
+	}
+	for _, c := range shown {
+		lines = append(lines, fmt.Sprintf("• `%s` %s (%s)", c.SHA, c.Subject, c.Author))
+	}
+	if more := len(commits) - len(shown); more > 0 {
+		lines = append(lines, fmt.Sprintf("…and %d more", more))
+	}
+
+	if keys := ticketKeys(commits); len(keys) > 0 {
+		lines = append(lines, "Tickets: "+strings.Join(keys, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
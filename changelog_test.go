@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTicketKeys(t *testing.T) {
+	commits := []commit{
+		{SHA: "c3", Subject: "PAY-12 Take card payments"},
+		{SHA: "c2", Subject: "Merge OPS-7 and PAY-12 (#40)"},
+		{SHA: "c1", Subject: "Tidy up, see pay-3 and X-1"},
+		{SHA: "c0", Subject: "Bump deps for SEC2-100"},
+	}
+
+	want := []string{"PAY-12", "OPS-7", "SEC2-100"}
+	if got := ticketKeys(commits); !reflect.DeepEqual(got, want) {
+		t.Errorf("ticketKeys() = %v, want %v", got, want)
+	}
+	if got := ticketKeys(commits[2:3]); got != nil {
+		t.Errorf("ticketKeys() without keys = %v, want none", got)
+	}
+}
+
+func TestFormatChangelog(t *testing.T) {
+	commits := []commit{
+		{SHA: "c3c3c3c", Subject: "PAY-12 Take card payments", Author: "Ana"},
+		{SHA: "b2b2b2b", Subject: "Fix the build", Author: "Ben"},
+		{SHA: "a1a1a1a", Subject: "OPS-7 Add alarms", Author: "Cy"},
+	}
+
+	tests := []struct {
+		name    string
+		commits []commit
+		max     int
+		want    string
+	}{
+		{
+			name:    "all",
+			commits: commits,
+			max:     5,
+			want:    "• `c3c3c3c` PAY-12 Take card payments (Ana)\n• `b2b2b2b` Fix the build (Ben)\n• `a1a1a1a` OPS-7 Add alarms (Cy)\nTickets: PAY-12, OPS-7",
+		},
+		{
+			name:    "more than max",
+			commits: commits,
+			max:     1,
+			want:    "• `c3c3c3c` PAY-12 Take card payments (Ana)\n…and 2 more\nTickets: PAY-12, OPS-7",
+		},
+		{
+			name:    "no tickets",
+			commits: commits[1:2],
+			max:     5,
+			want:    "• `b2b2b2b` Fix the build (Ben)",
+		},
+		{
+			name: "none",
+			max:  5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatChangelog(tt.commits, tt.max); got != tt.want {
+				t.Errorf("formatChangelog() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
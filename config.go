@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Config is the optional JSON configuration file passed with -config. Values
+// given on the command line take precedence over the file.
+type Config struct {
+	Environments map[string]EnvironmentConfig `json:"environments"`
+	// Notifiers are sent to for every environment
+	Notifiers []NotifierConfig `json:"notifiers"`
+	// History is where every deploy is recorded
+	History HistoryConfig `json:"history"`
+	// Network says how to reach AWS and the other services deploys talk to
+	Network NetworkConfig `json:"network"`
+}
+
+// NetworkConfig sets custom AWS endpoints, e.g. for LocalStack, and how to
+// get out of a restricted network. The flags of the same names override it.
+type NetworkConfig struct {
+	// ECSEndpoint and STSEndpoint are URLs used instead of the AWS ones
+	ECSEndpoint string `json:"ecs_endpoint"`
+	STSEndpoint string `json:"sts_endpoint"`
+	// HTTPSProxy is the proxy for HTTPS requests, to AWS, webhooks and the preflight URL
+	HTTPSProxy string `json:"https_proxy"`
+	// CABundle is a PEM file of certificates to trust besides the system ones
+	CABundle string `json:"ca_bundle"`
+	// MaxRetries is how many times the AWS SDK retries a request
+	MaxRetries *int `json:"max_retries"`
+}
+
+// HistoryConfig configures the deploy history, overridden by -history and
+// -history-endpoint.
+type HistoryConfig struct {
+	// URL is a JSON lines file or s3://bucket/prefix
+	URL string `json:"url"`
+	// Endpoint is the URL of an S3 compatible store, if not AWS
+	Endpoint string `json:"endpoint"`
+	// Region is the AWS region of the bucket, defaulting to the first -r
+	Region string `json:"region"`
+}
+
+// NotifierConfig configures one place deploys are notified to. Type is one of
+// slack, teams, discord or webhook (the full deploy event as JSON).
+type NotifierConfig struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// Channels are the Slack channels to post to, if not the webhook's default
+	Channels []string `json:"channels"`
+	// Format is rich or plain for Slack, defaulting to -slack-format
+	Format string `json:"format"`
+}
+
+// EnvironmentConfig holds the settings for a single application environment,
+// keyed by the -e value.
+type EnvironmentConfig struct {
+	// AccountID is the AWS account deploys to this environment must run as
+	AccountID string `json:"account_id"`
+	// Role is the IAM role name or ARN deploys to this environment must run as
+	Role string `json:"role"`
+	// Clusters are deployed to when no -c is given
+	Clusters []string `json:"clusters"`
+	// Waves split the apps into groups deployed one after another
+	Waves []Wave `json:"waves"`
+	// Notifiers are sent to for this environment, as well as the global ones
+	Notifiers []NotifierConfig `json:"notifiers"`
+}
+
+// Wave is one step of a rollout. It takes the apps listed, or a percentage of
+// the apps not in an earlier wave, or failing both every app left over.
+type Wave struct {
+	Name    string   `json:"name"`
+	Apps    []string `json:"apps"`
+	Percent int      `json:"percent"`
+	// Pause is how long to wait after the wave before starting the next, e.g. "10m"
+	Pause string `json:"pause"`
+	// Approve asks for confirmation on stdin before starting the next wave
+	Approve bool `json:"approve"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open config %s: %v", path, err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// environment returns the configuration for the named environment, which is
+// empty if the file doesn't mention it.
+func (c *Config) environment(name string) EnvironmentConfig {
+	return c.Environments[name]
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// webIdentityExpiryWindow is how long before the session actually expires that
+// the credentials are considered stale, so that a refresh happens before a
+// long-running request is rejected.
+const webIdentityExpiryWindow = 5 * time.Minute
+
+// credentialFlagNames are the flags webIdentityCredentials reads, shared with
+// the history command
+var credentialFlagNames = []string{"role-arn", "web-identity-token-file", "web-identity-token-env", "role-session-name"}
+
+// credentialFlags adds the credential flags to another command's flags
+func credentialFlags(fs *flag.FlagSet) {
+	for _, name := range credentialFlagNames {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, name, f.Usage)
+	}
+}
+
+// webIdentityProvider exchanges an OIDC token issued by the CI provider for a
+// role session via STS AssumeRoleWithWebIdentity. The token is re-read on every
+// refresh, since most CI providers rotate it on disk.
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client      *sts.STS
+	roleARN     string
+	sessionName string
+	token       func() (string, error)
+}
+
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	token, err := p.token()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	res, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.sessionName),
+		WebIdentityToken: aws.String(token),
+	})
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	p.SetExpiration(*res.Credentials.Expiration, webIdentityExpiryWindow)
+
+	return credentials.Value{
+		AccessKeyID:     *res.Credentials.AccessKeyId,
+		SecretAccessKey: *res.Credentials.SecretAccessKey,
+		SessionToken:    *res.Credentials.SessionToken,
+		ProviderName:    "WebIdentityProvider",
+	}, nil
+}
+
+// webIdentityToken returns a function reading the OIDC token from tokenFile,
+// or failing that from the environment variable named tokenEnv.
+func webIdentityToken(tokenFile string, tokenEnv string) func() (string, error) {
+	return func() (string, error) {
+		if tokenFile != "" {
+			b, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return "", fmt.Errorf("unable to read web identity token: %v", err)
+			}
+			return strings.TrimSpace(string(b)), nil
+		}
+		if tokenEnv == "" {
+			return "", errors.New("no web identity token file or variable specified")
+		}
+		if token := os.Getenv(tokenEnv); token != "" {
+			return token, nil
+		}
+		return "", errors.New("no web identity token found in " + tokenEnv)
+	}
+}
+
+// webIdentityCredentials returns credentials for roleARN obtained with a web
+// identity token, or nil if no role was requested. The returned credentials
+// refresh themselves when they expire.
+func webIdentityCredentials(sess *session.Session) *credentials.Credentials {
+	roleARN := *webIdentityRoleARN
+	if roleARN == "" {
+		roleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	if roleARN == "" {
+		return nil
+	}
+
+	tokenFile := *webIdentityTokenFile
+	if tokenFile == "" && *webIdentityTokenEnv == "" {
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+
+	// AssumeRoleWithWebIdentity is authenticated by the token itself
+	client := sts.New(sess, &aws.Config{Credentials: credentials.AnonymousCredentials})
+
+	return credentials.NewCredentials(&webIdentityProvider{
+		client:      client,
+		roleARN:     roleARN,
+		sessionName: *webIdentitySessionName,
+		token:       webIdentityToken(tokenFile, *webIdentityTokenEnv),
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWebIdentityToken(t *testing.T) {
+	f, err := ioutil.TempFile("", "web-identity-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(" file-token\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	os.Setenv("TEST_WEB_IDENTITY_TOKEN", "env-token")
+	defer os.Unsetenv("TEST_WEB_IDENTITY_TOKEN")
+
+	tests := []struct {
+		name      string
+		tokenFile string
+		tokenEnv  string
+		want      string
+		wantErr   bool
+	}{
+		{name: "file", tokenFile: f.Name(), want: "file-token"},
+		{name: "file before variable", tokenFile: f.Name(), tokenEnv: "TEST_WEB_IDENTITY_TOKEN", want: "file-token"},
+		{name: "variable", tokenEnv: "TEST_WEB_IDENTITY_TOKEN", want: "env-token"},
+		{name: "missing file", tokenFile: f.Name() + ".missing", wantErr: true},
+		{name: "empty variable", tokenEnv: "TEST_WEB_IDENTITY_TOKEN_UNSET", wantErr: true},
+		{name: "neither", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := webIdentityToken(tt.tokenFile, tt.tokenEnv)()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("webIdentityToken() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("webIdentityToken() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
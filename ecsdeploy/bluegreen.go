@@ -0,0 +1,147 @@
+package ecsdeploy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// Colours of the two services in a blue/green pair
+const (
+	Blue  = "blue"
+	Green = "green"
+)
+
+// LiveColourTag records which service of a blue/green pair is serving traffic
+const LiveColourTag = "go-ecs-deploy:live-colour"
+
+// ColourServiceName is the service running one colour of a service
+func ColourServiceName(serviceName string, colour string) string {
+	return serviceName + "-" + colour
+}
+
+// colourPair is the blue and green services of an app, split by which one is
+// currently live.
+type colourPair struct {
+	live, idle             *ecs.Service
+	liveColour, idleColour string
+}
+
+// colourPairs finds the live and idle colour of each service. The live colour
+// is the one recorded in the service tags by the previous deploy, or failing
+// that the one with more tasks.
+func (d *deployment) colourPairs(ctx context.Context, services map[string]*ecs.Service, serviceNames []string) (map[string]*colourPair, error) {
+	pairs := map[string]*colourPair{}
+
+	for _, serviceName := range serviceNames {
+		b, g := services[ColourServiceName(serviceName, Blue)], services[ColourServiceName(serviceName, Green)]
+		if b == nil || g == nil {
+			return nil, fmt.Errorf("Failed: No services %s and %s found on cluster %s", ColourServiceName(serviceName, Blue), ColourServiceName(serviceName, Green), d.target.Cluster)
+		}
+
+		liveColour := d.taggedColour(ctx, b)
+		if liveColour == "" {
+			liveColour = d.taggedColour(ctx, g)
+		}
+		if liveColour == "" {
+			liveColour = Blue
+			if aws.Int64Value(g.DesiredCount) > aws.Int64Value(b.DesiredCount) {
+				liveColour = Green
+			}
+		}
+
+		if liveColour == Blue {
+			pairs[serviceName] = &colourPair{live: b, idle: g, liveColour: Blue, idleColour: Green}
+		} else {
+			pairs[serviceName] = &colourPair{live: g, idle: b, liveColour: Green, idleColour: Blue}
+		}
+		d.log.Printf("%s is live on %s", serviceName, liveColour)
+	}
+
+	return pairs, nil
+}
+
+// taggedColour returns the live colour recorded on a service, if any
+func (d *deployment) taggedColour(ctx context.Context, service *ecs.Service) string {
+	res, err := d.svc.ListTagsForResourceWithContext(ctx, &ecs.ListTagsForResourceInput{ResourceArn: service.ServiceArn})
+	if err != nil {
+		return ""
+	}
+	for _, tag := range res.Tags {
+		if *tag.Key == LiveColourTag && (*tag.Value == Blue || *tag.Value == Green) {
+			return *tag.Value
+		}
+	}
+	return ""
+}
+
+// swapColours deploys the new task definition to the idle colour, scales it up
+// to match the live colour and, once it's stable, scales the live colour down
+// to zero. The old colour is kept on its task definition for instant rollback.
+func (d *deployment) swapColours(ctx context.Context, log logger, appName string, pair *colourPair, newArn *string) error {
+	idleName := *pair.idle.ServiceName
+
+	d.mu.Lock()
+	d.swapped = append(d.swapped, pair)
+	d.mu.Unlock()
+
+	if err := d.updateService(ctx, log, idleName, pair.live.DesiredCount, newArn); err != nil {
+		return err
+	}
+	if err := d.waitForService(ctx, log, appName, idleName); err != nil {
+		return err
+	}
+
+	if err := d.scaleService(ctx, pair.live, 0); err != nil {
+		return err
+	}
+	log.Printf("Scaled %s down to 0", *pair.live.ServiceName)
+
+	return d.tagLiveColour(ctx, pair, pair.idleColour)
+}
+
+// revertColours undoes any blue/green swaps, putting the previously live
+// colour back to its original size and the other colour back to its own.
+func (d *deployment) revertColours() error {
+	ctx := aws.BackgroundContext()
+	for _, pair := range d.swapped {
+		if err := d.scaleService(ctx, pair.live, aws.Int64Value(pair.live.DesiredCount)); err != nil {
+			return fmt.Errorf("Failed: rollback of %s \n`%s`", *pair.live.ServiceName, err.Error())
+		}
+		if err := d.scaleService(ctx, pair.idle, aws.Int64Value(pair.idle.DesiredCount)); err != nil {
+			return fmt.Errorf("Failed: rollback of %s \n`%s`", *pair.idle.ServiceName, err.Error())
+		}
+		if err := d.tagLiveColour(ctx, pair, pair.liveColour); err != nil {
+			return fmt.Errorf("Failed: rollback of %s \n`%s`", *pair.live.ServiceName, err.Error())
+		}
+		d.log.Printf("Switched %s back to live", *pair.live.ServiceName)
+	}
+	d.swapped = nil
+	return nil
+}
+
+func (d *deployment) scaleService(ctx context.Context, service *ecs.Service, count int64) error {
+	_, err := d.svc.UpdateServiceWithContext(ctx,
+		&ecs.UpdateServiceInput{
+			Cluster:      &d.target.Cluster,
+			Service:      service.ServiceName,
+			DesiredCount: aws.Int64(count),
+		})
+	return err
+}
+
+// tagLiveColour records the live colour on both services of the pair
+func (d *deployment) tagLiveColour(ctx context.Context, pair *colourPair, colour string) error {
+	for _, service := range []*ecs.Service{pair.live, pair.idle} {
+		_, err := d.svc.TagResourceWithContext(ctx, &ecs.TagResourceInput{
+			ResourceArn: service.ServiceArn,
+			Tags:        []*ecs.Tag{{Key: aws.String(LiveColourTag), Value: aws.String(colour)}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package ecsdeploy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// canaryPollInterval is how often canary tasks are checked while baking
+const canaryPollInterval = 15 * time.Second
+
+// CanaryServiceName is the service running the canary for a service
+func CanaryServiceName(serviceName string) string {
+	return serviceName + "-canary"
+}
+
+// runCanary moves the canary services onto the new task definition, waits for
+// them to stabilise and then watches them for CanaryBake. If any canary task
+// stops in that time the canaries are reverted and an error returned, so that
+// the rest of the services are left alone.
+func (d *deployment) runCanary(ctx context.Context, services map[string]*ecs.Service, serviceNames []string, newArn *string) error {
+	var canaries []string
+	for _, serviceName := range serviceNames {
+		if _, ok := services[CanaryServiceName(serviceName)]; ok {
+			canaries = append(canaries, CanaryServiceName(serviceName))
+		}
+	}
+	if len(canaries) == 0 {
+		return fmt.Errorf("Failed: canary deployment to %s, no canary services found", d.target.Cluster)
+	}
+
+	err := d.deployCanaries(ctx, canaries, newArn)
+	if err != nil {
+		if revertErr := d.revertCanaries(canaries); revertErr != nil {
+			d.log.Printf("%s", revertErr)
+			return &Error{ErrorCategory(err), fmt.Sprintf("Failed: canary deployment %s to %s \n`%s`\nCanary revert failed", d.image, d.target.Cluster, err.Error())}
+		}
+		return &Error{CategoryRolledBack, fmt.Sprintf("Failed: canary deployment %s to %s, canary reverted \n`%s`", d.image, d.target.Cluster, err.Error())}
+	}
+
+	d.log.Printf("Canary is healthy, deploying to the remaining services")
+	return nil
+}
+
+func (d *deployment) deployCanaries(ctx context.Context, canaries []string, newArn *string) error {
+	for _, canary := range canaries {
+		if err := d.updateService(ctx, d.log, canary, nil, newArn); err != nil {
+			return err
+		}
+	}
+	for _, canary := range canaries {
+		if err := d.waitForService(ctx, d.log, "", canary); err != nil {
+			return err
+		}
+	}
+
+	bake := d.Options.CanaryBake
+	d.log.Printf("Baking canary for %s", bake)
+
+	since := time.Now()
+	for end := since.Add(bake); ; {
+		for _, canary := range canaries {
+			stopped, err := d.stoppedTasks(ctx, canary, *newArn, since)
+			if err != nil {
+				return err
+			}
+			if len(stopped) > 0 {
+				task := stopped[0]
+				return fmt.Errorf("%d task(s) of %s stopped while baking, e.g. %s: %s", len(stopped), canary, *task.TaskArn, aws.StringValue(task.StoppedReason))
+			}
+		}
+
+		left := time.Until(end)
+		if left <= 0 {
+			return nil
+		}
+		if left > canaryPollInterval {
+			left = canaryPollInterval
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(left):
+		}
+	}
+}
+
+// revertCanaries points the canary services back at their previous task definitions
+func (d *deployment) revertCanaries(canaries []string) error {
+	for _, canary := range canaries {
+		previous := d.previous[canary]
+		if previous == nil {
+			continue
+		}
+		_, err := d.svc.UpdateServiceWithContext(aws.BackgroundContext(),
+			&ecs.UpdateServiceInput{
+				Cluster:        &d.target.Cluster,
+				Service:        aws.String(canary),
+				TaskDefinition: previous,
+			})
+		if err != nil {
+			return fmt.Errorf("Failed: reverting canary %s to %s \n`%s`", canary, *previous, err.Error())
+		}
+		d.log.Printf("Reverted canary %s to ARN: %s", canary, *previous)
+	}
+	return nil
+}
+
+// stoppedTasks returns the tasks of a service running taskDefinition that have
+// stopped since the given time.
+func (d *deployment) stoppedTasks(ctx context.Context, serviceName string, taskDefinition string, since time.Time) ([]*ecs.Task, error) {
+	list, err := d.svc.ListTasksWithContext(ctx, &ecs.ListTasksInput{
+		Cluster:       &d.target.Cluster,
+		ServiceName:   &serviceName,
+		DesiredStatus: aws.String(ecs.DesiredStatusStopped),
+	})
+	if err != nil || len(list.TaskArns) == 0 {
+		return nil, err
+	}
+
+	tasks, err := d.svc.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+		Cluster: &d.target.Cluster,
+		Tasks:   list.TaskArns,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var stopped []*ecs.Task
+	for _, task := range tasks.Tasks {
+		if aws.StringValue(task.TaskDefinitionArn) != taskDefinition {
+			continue
+		}
+		if task.StoppedAt != nil && task.StoppedAt.After(since) {
+			stopped = append(stopped, task)
+		}
+	}
+	return stopped, nil
+}
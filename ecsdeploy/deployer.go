@@ -0,0 +1,296 @@
+// Package ecsdeploy deploys a new image to ECS services. It is the engine of
+// the go-ecs-deploy command, for use from other Go tooling.
+//
+// A deploy registers a new task definition based on the first app's service
+// and points every app's service at it, on each cluster in each region it is
+// given. Services can go out all at once, behind a canary, as blue/green
+// pairs or in waves, and can be locked against concurrent deploys.
+package ecsdeploy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Defaults for the Options left unset
+const (
+	DefaultWaitTimeout = 10 * time.Minute
+	DefaultCanaryBake  = 5 * time.Minute
+	DefaultLockTTL     = 30 * time.Minute
+)
+
+// What to do with the other targets when the deploy to one of them fails
+const (
+	OnFailureContinue = "continue"
+	OnFailureStop     = "stop"
+	OnFailureRollback = "rollback"
+)
+
+// Statuses of targets and services
+const (
+	StatusDeployed   = "deployed"
+	StatusFailed     = "failed"
+	StatusSkipped    = "skipped"
+	StatusPending    = "pending"
+	StatusRolledBack = "rolled_back"
+)
+
+// Options say what to deploy and how
+type Options struct {
+	// Apps are deployed to the services named <app>-<environment>. The first
+	// app's service is the template for the new task definition.
+	Apps        []string
+	Environment string
+
+	// Image is the image to deploy. Without it SHA is deployed from Repo, or
+	// with MultiContainer as the new tag of every container's own image.
+	Image          string
+	Repo           string
+	SHA            string
+	MultiContainer bool
+
+	// Parallelism is how many services to update at once
+	Parallelism int
+	// Wait waits for each service to become stable, for up to WaitTimeout
+	Wait        bool
+	WaitTimeout time.Duration
+
+	// Canary deploys to each app's <app>-<env>-canary service first and only
+	// carries on if no canary task stops within CanaryBake
+	Canary     bool
+	CanaryBake time.Duration
+	// BlueGreen deploys to the idle one of each app's <app>-<env>-blue and
+	// -green services and swaps it live
+	BlueGreen bool
+
+	// Lock takes an advisory lock, stored as tags, on each service. A lock
+	// held by another deploy is waited on for WaitForLock, or taken over with
+	// BreakLock. Locks are considered abandoned after LockTTL.
+	Lock        bool
+	WaitForLock time.Duration
+	BreakLock   bool
+	LockTTL     time.Duration
+
+	// Waves split the apps into groups deployed one after another
+	Waves []Wave
+
+	// TargetParallelism is how many targets to deploy to at once, and
+	// OnFailure what to do with the others when one fails
+	TargetParallelism int
+	OnFailure         string
+
+	// DeployID identifies the deploy and Owner who is running it, e.g. on locks
+	DeployID string
+	Owner    string
+
+	// TaskDefinitionTags are added to the new task definition
+	TaskDefinitionTags map[string]string
+
+	// Debug includes the old and new task definitions in the progress events
+	Debug bool
+}
+
+// Wave is one step of a rollout. It takes the apps listed, or a percentage of
+// the apps not in an earlier wave, or failing both every app left over.
+type Wave struct {
+	Name    string
+	Apps    []string
+	Percent int
+	// Pause is how long to wait after the wave before starting the next
+	Pause time.Duration
+	// Approve asks Deployer.Approve before starting the next wave
+	Approve bool
+}
+
+// Target is a single cluster in a single region to deploy to
+type Target struct {
+	Region  string
+	Cluster string
+}
+
+// Targets returns every combination of region and cluster, grouped by region
+func Targets(regions []string, clusters []string) []Target {
+	var ts []Target
+	for _, region := range regions {
+		for _, cluster := range clusters {
+			ts = append(ts, Target{Region: region, Cluster: cluster})
+		}
+	}
+	return ts
+}
+
+// TargetResult is the outcome of the deploy to one target
+type TargetResult struct {
+	Target
+	Status                    string
+	TaskDefinitionARN         string
+	PreviousTaskDefinitionARN string
+	Image                     string
+	PreviousImage             string
+	// Services are the outcomes of each app's service, in app order
+	Services []ServiceResult
+	// Err says why the target failed
+	Err        error
+	RolledBack bool
+}
+
+// ServiceResult is the outcome for a single service
+type ServiceResult struct {
+	App                       string     `json:"-"`
+	Name                      string     `json:"name"`
+	Status                    string     `json:"status"`
+	PreviousTaskDefinitionARN string     `json:"previous_task_definition_arn,omitempty"`
+	StartedAt                 *time.Time `json:"started_at,omitempty"`
+	FinishedAt                *time.Time `json:"finished_at,omitempty"`
+	DurationSeconds           float64    `json:"duration_seconds,omitempty"`
+	// LiveColour is the colour now live with BlueGreen
+	LiveColour string `json:"-"`
+}
+
+// Deployer runs deploys
+type Deployer struct {
+	Options Options
+
+	// Client returns the ECS client to use in a region
+	Client func(region string) ECSAPI
+
+	// OnEvent, if set, receives progress messages. It's called from every
+	// target and service being deployed at once.
+	OnEvent func(Event)
+
+	// Phase, if set, is called as each phase starts, e.g. to time or trace it.
+	// It returns the context to run the phase in and a function called with
+	// the phase's outcome when it ends.
+	Phase func(ctx context.Context, p Phase) (context.Context, func(error))
+
+	// Approve is asked whether to carry on after a wave that needs approval.
+	// Without it such waves are never approved.
+	Approve func(ctx context.Context, t Target, wave string) bool
+}
+
+// New returns a Deployer using client in each region, with the defaults
+// filled in for any options left unset.
+func New(client func(region string) ECSAPI, opts Options) *Deployer {
+	if opts.Parallelism < 1 {
+		opts.Parallelism = 1
+	}
+	if opts.TargetParallelism < 1 {
+		opts.TargetParallelism = 1
+	}
+	if opts.WaitTimeout == 0 {
+		opts.WaitTimeout = DefaultWaitTimeout
+	}
+	if opts.CanaryBake == 0 {
+		opts.CanaryBake = DefaultCanaryBake
+	}
+	if opts.LockTTL == 0 {
+		opts.LockTTL = DefaultLockTTL
+	}
+	if opts.OnFailure == "" {
+		opts.OnFailure = OnFailureContinue
+	}
+	return &Deployer{Options: opts, Client: client}
+}
+
+// Validate checks the options make sense
+func (dep *Deployer) Validate() error {
+	o := dep.Options
+	switch {
+	case len(o.Apps) == 0 || o.Environment == "":
+		return &Error{CategoryBadInput, "no apps or environment specified"}
+	case o.Image == "" && (o.Repo == "" || o.SHA == ""):
+		return &Error{CategoryBadInput, "no repo name, sha or image specified"}
+	case o.Canary && o.BlueGreen:
+		return &Error{CategoryBadInput, "canary and blue/green deploys can't be combined"}
+	}
+
+	switch o.OnFailure {
+	case OnFailureContinue, OnFailureStop, OnFailureRollback:
+	default:
+		return &Error{CategoryBadInput, "unknown failure mode " + o.OnFailure}
+	}
+	return nil
+}
+
+// Deploy deploys to each target, at most TargetParallelism at a time, and
+// returns the results in the order the targets were given. It only fails
+// outright if the options are invalid; how each target went is in its result.
+func (dep *Deployer) Deploy(ctx context.Context, targets []Target) ([]*TargetResult, error) {
+	if err := dep.Validate(); err != nil {
+		return nil, err
+	}
+	waves := planWaves(dep.Options.Waves, dep.Options.Apps)
+
+	clients := map[string]ECSAPI{}
+	deployments := make([]*deployment, len(targets))
+	sem := make(chan struct{}, dep.Options.TargetParallelism)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := false
+
+	for i, t := range targets {
+		sem <- struct{}{}
+
+		mu.Lock()
+		stop := failed && dep.Options.OnFailure != OnFailureContinue
+		mu.Unlock()
+		if stop {
+			<-sem
+			logger{dep: dep, target: t}.Printf("Skipping after an earlier failure")
+			continue
+		}
+
+		svc, ok := clients[t.Region]
+		if !ok {
+			svc = dep.Client(t.Region)
+			clients[t.Region] = svc
+		}
+		d := newDeployment(dep, t, svc, waves)
+		deployments[i] = d
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ctx, end := dep.phase(ctx, Phase{Name: PhaseTarget, Target: d.target})
+			d.err = d.run(ctx)
+			end(d.err)
+			if d.err != nil {
+				if len(targets) > 1 {
+					d.log.Printf("%s", d.err)
+				}
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed && dep.Options.OnFailure == OnFailureRollback {
+		for _, d := range deployments {
+			if d == nil {
+				continue
+			}
+			_, end := dep.phase(ctx, Phase{Name: PhaseRollback, Target: d.target})
+			err := d.rollback()
+			end(err)
+			if err != nil {
+				d.log.Printf("%s", err)
+			}
+		}
+	}
+
+	results := make([]*TargetResult, len(targets))
+	for i, d := range deployments {
+		if d == nil {
+			results[i] = &TargetResult{Target: targets[i], Status: StatusSkipped, Services: []ServiceResult{}}
+			continue
+		}
+		d.unlock()
+		results[i] = d.result()
+	}
+	return results, nil
+}
@@ -0,0 +1,250 @@
+package ecsdeploy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeploy(t *testing.T) {
+	heldLock := func(f *Fixture) {
+		f.Clusters[testCluster].Services[0].Tags = map[string]string{
+			LockOwnerTag:   "someone else",
+			LockIDTag:      "other-deploy",
+			LockExpiresTag: time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		fixture func(*Fixture)
+		opts    Options
+		targets []string
+		// statuses are the statuses of the targets, and category that of the
+		// first target's error, if any
+		statuses []string
+		category string
+		check    func(t *testing.T, s *Simulator, results []*TargetResult)
+	}{
+		{
+			name:     "deploy",
+			opts:     Options{Apps: []string{"web", "api"}, Image: "vend/web:v2", Wait: true},
+			statuses: []string{StatusDeployed},
+			check: func(t *testing.T, s *Simulator, results []*TargetResult) {
+				for _, name := range []string{"web-test", "api-test"} {
+					if td := *service(t, s, name).TaskDefinition; td != taskDefinitionARN("web:2") {
+						t.Errorf("%s task definition = %s, want web:2", name, td)
+					}
+				}
+				if td := *service(t, s, "web-test-canary").TaskDefinition; td != taskDefinitionARN("web:1") {
+					t.Errorf("canary task definition = %s, want web:1", td)
+				}
+				if results[0].PreviousImage != "vend/web:v1" || results[0].Image != "vend/web:v2" {
+					t.Errorf("images = %s to %s, want vend/web:v1 to vend/web:v2", results[0].PreviousImage, results[0].Image)
+				}
+			},
+		},
+		{
+			name:     "rollback across targets",
+			opts:     Options{Apps: []string{"web"}, Image: "vend/web:v2", OnFailure: OnFailureRollback},
+			targets:  []string{testCluster, "missing"},
+			statuses: []string{StatusRolledBack, StatusFailed},
+			check: func(t *testing.T, s *Simulator, results []*TargetResult) {
+				if td := *service(t, s, "web-test").TaskDefinition; td != taskDefinitionARN("web:1") {
+					t.Errorf("web-test task definition = %s, want web:1", td)
+				}
+				if results[0].Err != nil {
+					t.Errorf("rolled back target failed itself: %v", results[0].Err)
+				}
+			},
+		},
+		{
+			name:     "stop after a failed target",
+			opts:     Options{Apps: []string{"web"}, Image: "vend/web:v2", OnFailure: OnFailureStop},
+			targets:  []string{"missing", testCluster},
+			statuses: []string{StatusFailed, StatusSkipped},
+			category: CategoryAWS,
+			check: func(t *testing.T, s *Simulator, results []*TargetResult) {
+				if td := *service(t, s, "web-test").TaskDefinition; td != taskDefinitionARN("web:1") {
+					t.Errorf("web-test task definition = %s, want web:1", td)
+				}
+			},
+		},
+		{
+			name:     "lock released",
+			opts:     Options{Apps: []string{"web"}, Image: "vend/web:v2", Lock: true, DeployID: "this-deploy"},
+			statuses: []string{StatusDeployed},
+			check: func(t *testing.T, s *Simulator, results []*TargetResult) {
+				if id, ok := serviceTags(t, s, "web-test")[LockIDTag]; ok {
+					t.Errorf("lock still held by %s", id)
+				}
+			},
+		},
+		{
+			name:     "lock held",
+			fixture:  heldLock,
+			opts:     Options{Apps: []string{"web"}, Image: "vend/web:v2", Lock: true, DeployID: "this-deploy"},
+			statuses: []string{StatusFailed},
+			category: CategoryLockHeld,
+			check: func(t *testing.T, s *Simulator, results []*TargetResult) {
+				if td := *service(t, s, "web-test").TaskDefinition; td != taskDefinitionARN("web:1") {
+					t.Errorf("web-test task definition = %s, want web:1", td)
+				}
+				if id := serviceTags(t, s, "web-test")[LockIDTag]; id != "other-deploy" {
+					t.Errorf("lock held by %q, want other-deploy", id)
+				}
+			},
+		},
+		{
+			name:     "lock broken",
+			fixture:  heldLock,
+			opts:     Options{Apps: []string{"web"}, Image: "vend/web:v2", Lock: true, BreakLock: true, DeployID: "this-deploy"},
+			statuses: []string{StatusDeployed},
+			check: func(t *testing.T, s *Simulator, results []*TargetResult) {
+				if td := *service(t, s, "web-test").TaskDefinition; td != taskDefinitionARN("web:2") {
+					t.Errorf("web-test task definition = %s, want web:2", td)
+				}
+				if id, ok := serviceTags(t, s, "web-test")[LockIDTag]; ok {
+					t.Errorf("lock still held by %s", id)
+				}
+			},
+		},
+		{
+			name:     "healthy canary",
+			opts:     Options{Apps: []string{"web"}, Image: "vend/web:v2", Canary: true, CanaryBake: 100 * time.Millisecond},
+			statuses: []string{StatusDeployed},
+			check: func(t *testing.T, s *Simulator, results []*TargetResult) {
+				for _, name := range []string{"web-test", "web-test-canary"} {
+					if td := *service(t, s, name).TaskDefinition; td != taskDefinitionARN("web:2") {
+						t.Errorf("%s task definition = %s, want web:2", name, td)
+					}
+				}
+			},
+		},
+		{
+			name: "canary crashes while baking",
+			fixture: func(f *Fixture) {
+				f.Failures.CrashAfter = "200ms"
+			},
+			opts:     Options{Apps: []string{"web"}, Image: "vend/web:bad", Canary: true, CanaryBake: time.Second},
+			statuses: []string{StatusFailed},
+			category: CategoryRolledBack,
+			check: func(t *testing.T, s *Simulator, results []*TargetResult) {
+				for _, name := range []string{"web-test", "web-test-canary"} {
+					if td := *service(t, s, name).TaskDefinition; td != taskDefinitionARN("web:1") {
+						t.Errorf("%s task definition = %s, want web:1", name, td)
+					}
+				}
+				if status := results[0].Services[0].Status; status != StatusPending {
+					t.Errorf("web-test status = %s, want %s", status, StatusPending)
+				}
+			},
+		},
+		{
+			name:     "blue/green swap",
+			opts:     Options{Apps: []string{"web"}, Image: "vend/web:v2", BlueGreen: true},
+			statuses: []string{StatusDeployed},
+			check: func(t *testing.T, s *Simulator, results []*TargetResult) {
+				green, blue := service(t, s, "web-test-green"), service(t, s, "web-test-blue")
+				if *green.TaskDefinition != taskDefinitionARN("web:2") || *green.DesiredCount != 2 {
+					t.Errorf("green = %s x %d, want web:2 x 2", *green.TaskDefinition, *green.DesiredCount)
+				}
+				if *blue.TaskDefinition != taskDefinitionARN("web:1") || *blue.DesiredCount != 0 {
+					t.Errorf("blue = %s x %d, want web:1 x 0", *blue.TaskDefinition, *blue.DesiredCount)
+				}
+				for _, name := range []string{"web-test-blue", "web-test-green"} {
+					if colour := serviceTags(t, s, name)[LiveColourTag]; colour != Green {
+						t.Errorf("live colour on %s = %q, want %q", name, colour, Green)
+					}
+				}
+				if colour := results[0].Services[0].LiveColour; colour != Green {
+					t.Errorf("live colour = %q, want %q", colour, Green)
+				}
+			},
+		},
+		{
+			name:     "blue/green revert",
+			opts:     Options{Apps: []string{"web"}, Image: "vend/web:bad", BlueGreen: true, WaitTimeout: 200 * time.Millisecond, OnFailure: OnFailureRollback},
+			statuses: []string{StatusRolledBack},
+			category: CategoryTimeout,
+			check: func(t *testing.T, s *Simulator, results []*TargetResult) {
+				green, blue := service(t, s, "web-test-green"), service(t, s, "web-test-blue")
+				if *green.TaskDefinition != taskDefinitionARN("web:1") || *green.DesiredCount != 0 {
+					t.Errorf("green = %s x %d, want web:1 x 0", *green.TaskDefinition, *green.DesiredCount)
+				}
+				if *blue.TaskDefinition != taskDefinitionARN("web:1") || *blue.DesiredCount != 2 {
+					t.Errorf("blue = %s x %d, want web:1 x 2", *blue.TaskDefinition, *blue.DesiredCount)
+				}
+				for _, name := range []string{"web-test-blue", "web-test-green"} {
+					if colour := serviceTags(t, s, name)[LiveColourTag]; colour != Blue {
+						t.Errorf("live colour on %s = %q, want %q", name, colour, Blue)
+					}
+				}
+			},
+		},
+		{
+			name:     "wave not approved",
+			opts:     Options{Apps: []string{"web", "api"}, Image: "vend/web:v2", Waves: []Wave{{Apps: []string{"web"}, Approve: true}}},
+			statuses: []string{StatusFailed},
+			category: CategoryAborted,
+			check: func(t *testing.T, s *Simulator, results []*TargetResult) {
+				if td := *service(t, s, "api-test").TaskDefinition; td != taskDefinitionARN("api:1") {
+					t.Errorf("api-test task definition = %s, want api:1", td)
+				}
+				if status := results[0].Services[1].Status; status != StatusPending {
+					t.Errorf("api-test status = %s, want %s", status, StatusPending)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := testFixture()
+			if tt.fixture != nil {
+				tt.fixture(f)
+			}
+			s, err := NewSimulator(testRegion, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			clusters := tt.targets
+			if clusters == nil {
+				clusters = []string{testCluster}
+			}
+			opts := tt.opts
+			opts.Environment = "test"
+			dep := New(func(string) ECSAPI { return s }, opts)
+			dep.OnEvent = func(e Event) { t.Logf("%s: %s", e.Target.Cluster, e.Message) }
+
+			results, err := dep.Deploy(context.Background(), Targets([]string{testRegion}, clusters))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var statuses []string
+			for _, r := range results {
+				statuses = append(statuses, r.Status)
+			}
+			if len(statuses) != len(tt.statuses) {
+				t.Fatalf("statuses = %v, want %v", statuses, tt.statuses)
+			}
+			for i := range statuses {
+				if statuses[i] != tt.statuses[i] {
+					t.Fatalf("statuses = %v, want %v", statuses, tt.statuses)
+				}
+			}
+
+			category := ""
+			if results[0].Err != nil {
+				category = ErrorCategory(results[0].Err)
+			}
+			if category != tt.category {
+				t.Errorf("category = %q, want %q (%v)", category, tt.category, results[0].Err)
+			}
+
+			tt.check(t, s, results)
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package ecsdeploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// stabilityPollInterval is how often the ECS services-stable waiter polls
+const stabilityPollInterval = 15 * time.Second
+
+// deployment deploys the requested image to every app on a single target,
+// remembering what it changed so that it can be reported on and rolled back.
+type deployment struct {
+	*Deployer
+	target Target
+	svc    ECSAPI
+	log    logger
+
+	// previous maps each service to the task definition it ran before the deploy
+	previous map[string]*string
+	// updated lists the services switched to newARN, in order
+	updated []string
+	// locked lists the ARNs of the services this deployment holds the lock on
+	locked []string
+	// stopRenewing stops the locks being renewed
+	stopRenewing func()
+	// swapped lists the blue/green pairs whose colours have started to swap
+	swapped []*colourPair
+
+	newARN        *string
+	image         string
+	previousImage string
+	// exemplar is the service the new task definition was based on
+	exemplar string
+
+	// outcomes record how each app's service fared, in app order
+	outcomes []*ServiceResult
+
+	// waves are the groups of apps to deploy, in order
+	waves []wave
+
+	err        error
+	rolledBack bool
+
+	mu sync.Mutex
+}
+
+func newDeployment(dep *Deployer, target Target, svc ECSAPI, waves []wave) *deployment {
+	return &deployment{
+		Deployer: dep,
+		target:   target,
+		svc:      svc,
+		log:      logger{dep: dep, target: target},
+		waves:    waves,
+		previous: map[string]*string{},
+	}
+}
+
+// result reports what the deployment did
+func (d *deployment) result() *TargetResult {
+	r := &TargetResult{
+		Target:        d.target,
+		Status:        StatusDeployed,
+		Image:         d.image,
+		PreviousImage: d.previousImage,
+		Services:      []ServiceResult{},
+		Err:           d.err,
+		RolledBack:    d.rolledBack,
+	}
+	if d.err != nil {
+		r.Status = StatusFailed
+	}
+	if d.rolledBack {
+		r.Status = StatusRolledBack
+	}
+	if d.newARN != nil {
+		r.TaskDefinitionARN = *d.newARN
+	}
+	if d.exemplar != "" && d.previous[d.exemplar] != nil {
+		r.PreviousTaskDefinitionARN = *d.previous[d.exemplar]
+	}
+	for _, s := range d.outcomes {
+		r.Services = append(r.Services, *s)
+	}
+	return r
+}
+
+// run registers a new task definition based on the first app's service and
+// points every app's service at it.
+func (d *deployment) run(ctx context.Context) error {
+	o := d.Options
+	cluster := d.target.Cluster
+
+	// Take the first app specified and use it for creating the task definitions for all services.
+	exemplarServiceName := o.Apps[0] + "-" + o.Environment
+
+	if o.Image == "" {
+		d.log.Printf("Request to deploy sha: %s to %s at %s", o.SHA, o.Environment, d.target.Region)
+	} else {
+		d.log.Printf("Request to deploy target image: %s to %s at %s", o.Image, o.Environment, d.target.Region)
+	}
+	d.log.Printf("Describing services for cluster %s and service %s", cluster, exemplarServiceName)
+
+	serviceNames := make([]string, len(o.Apps))
+	for i, appName := range o.Apps {
+		serviceNames[i] = appName + "-" + o.Environment
+	}
+
+	describe := serviceNames
+	switch {
+	case o.Canary:
+		for _, serviceName := range serviceNames {
+			describe = append(describe, CanaryServiceName(serviceName))
+		}
+	case o.BlueGreen:
+		describe = nil
+		for _, serviceName := range serviceNames {
+			describe = append(describe, ColourServiceName(serviceName, Blue), ColourServiceName(serviceName, Green))
+		}
+	}
+
+	services, err := DescribeServices(ctx, d.svc, cluster, describe)
+	if err != nil {
+		return fmt.Errorf("Failed to describe %s \n`%s`", exemplarServiceName, err.Error())
+	}
+
+	// with blue/green the new task definition is based on the live colour
+	var pairs map[string]*colourPair
+	var service *ecs.Service
+	if o.BlueGreen {
+		if pairs, err = d.colourPairs(ctx, services, serviceNames); err != nil {
+			return err
+		}
+		service = pairs[exemplarServiceName].live
+	} else if service = services[exemplarServiceName]; service == nil {
+		return fmt.Errorf("Failed: No service %s found on cluster %s", exemplarServiceName, cluster)
+	}
+	for name, s := range services {
+		d.previous[name] = s.TaskDefinition
+	}
+	d.exemplar = *service.ServiceName
+
+	for i, serviceName := range serviceNames {
+		outcome := &ServiceResult{App: o.Apps[i], Name: serviceName, Status: StatusPending}
+		if previous := d.previous[serviceName]; previous != nil {
+			outcome.PreviousTaskDefinitionARN = *previous
+		} else if pair := pairs[serviceName]; pair != nil {
+			outcome.PreviousTaskDefinitionARN = *pair.live.TaskDefinition
+		}
+		d.outcomes = append(d.outcomes, outcome)
+	}
+
+	d.log.Printf("Found existing ARN %s for service %s", *service.ClusterArn, *service.ServiceName)
+
+	if o.Lock {
+		if err := d.lock(ctx, services, describe); err != nil {
+			return err
+		}
+	}
+
+	taskDesc, err :=
+		d.svc.DescribeTaskDefinitionWithContext(ctx,
+			&ecs.DescribeTaskDefinitionInput{
+				TaskDefinition: service.TaskDefinition})
+	if err != nil {
+		return fmt.Errorf("Failed: deployment %s \n`%s`", exemplarServiceName, err.Error())
+	}
+
+	if o.Debug {
+		d.log.Printf("Current task description: \n%+v", taskDesc)
+	}
+
+	var containerDef *ecs.ContainerDefinition
+	var oldImage *string
+	// multiContainer service
+	if o.MultiContainer {
+		d.log.Printf("Task definition has multiple containers")
+		var i int
+		for i, containerDef = range taskDesc.TaskDefinition.ContainerDefinitions {
+			oldImage = containerDef.Image
+			x := o.Image
+			if o.Image == "" {
+				// Split repoName and Tag
+				imageString := *oldImage
+				pair := strings.Split(imageString, ":")
+				if len(pair) == 2 {
+					d.log.Printf("Updating sha on repo: %s", pair[0])
+					x = fmt.Sprintf("%s:%s", pair[0], o.SHA)
+				} else {
+					x = fmt.Sprintf("%s:%s", o.Repo, o.SHA)
+				}
+			}
+			containerDef.Image = &x
+			taskDesc.TaskDefinition.ContainerDefinitions[i] = containerDef
+		}
+	} else {
+		containerDef = taskDesc.TaskDefinition.ContainerDefinitions[0]
+		oldImage = containerDef.Image
+		x := o.Image
+		if o.Image == "" {
+			x = fmt.Sprintf("%s:%s", o.Repo, o.SHA)
+		}
+		containerDef.Image = &x
+	}
+
+	futureDef := &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    taskDesc.TaskDefinition.ContainerDefinitions,
+		Family:                  taskDesc.TaskDefinition.Family,
+		Volumes:                 taskDesc.TaskDefinition.Volumes,
+		NetworkMode:             taskDesc.TaskDefinition.NetworkMode,
+		TaskRoleArn:             taskDesc.TaskDefinition.TaskRoleArn,
+		Cpu:                     taskDesc.TaskDefinition.Cpu,
+		Memory:                  taskDesc.TaskDefinition.Memory,
+		RequiresCompatibilities: taskDesc.TaskDefinition.RequiresCompatibilities,
+		ExecutionRoleArn:        taskDesc.TaskDefinition.ExecutionRoleArn,
+		PlacementConstraints:    taskDesc.TaskDefinition.PlacementConstraints,
+	}
+
+	if o.Debug {
+		d.log.Printf("Future task description: \n%+v", futureDef)
+	}
+
+	registerCtx, endRegister := d.phase(ctx, Phase{Name: PhaseRegister, Target: d.target})
+	registerRes, err :=
+		d.registerTaskDefinition(registerCtx, futureDef)
+	endRegister(err)
+	if err != nil {
+		return fmt.Errorf("Failed: deployment %s for %s to %s \n`%s`", *containerDef.Image, exemplarServiceName, cluster, err.Error())
+	}
+
+	newArn := registerRes.TaskDefinition.TaskDefinitionArn
+	d.newARN = newArn
+
+	d.log.Printf("Registered new task for %s:%s", o.SHA, *newArn)
+
+	d.image = *taskDesc.TaskDefinition.ContainerDefinitions[0].Image
+	d.previousImage = *oldImage
+
+	// update services to use new definition, a few at a time, once the canary is happy
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if o.Canary {
+		canaryCtx, endCanary := d.phase(ctx, Phase{Name: PhaseCanary, Target: d.target})
+		err := d.runCanary(canaryCtx, services, serviceNames, newArn)
+		endCanary(err)
+		if err != nil {
+			return err
+		}
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+
+	// waves after the first only start once the earlier ones are stable
+	waitForStable := o.Wait || len(d.waves) > 1
+
+	updateWave := func(w wave) {
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+
+		for n := 0; n < o.Parallelism; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					appName, serviceName := o.Apps[i], serviceNames[i]
+
+					log := d.log
+					if o.Parallelism > 1 && len(w.apps) > 1 {
+						log.service = serviceName
+					}
+
+					started := time.Now().UTC()
+
+					var err error
+					var live string
+					if o.BlueGreen {
+						updateCtx, endUpdate := d.phase(ctx, Phase{Name: PhaseUpdate, Target: d.target, App: appName, Service: serviceName})
+						err = d.swapColours(updateCtx, log, appName, pairs[serviceName], newArn)
+						endUpdate(err)
+						live = pairs[serviceName].idleColour
+					} else {
+						updateCtx, endUpdate := d.phase(ctx, Phase{Name: PhaseUpdate, Target: d.target, App: appName, Service: serviceName})
+						err = d.updateService(updateCtx, log, serviceName, service.DesiredCount, newArn)
+						endUpdate(err)
+						if err == nil && waitForStable {
+							err = d.waitForService(ctx, log, appName, serviceName)
+						}
+					}
+
+					finished := time.Now().UTC()
+
+					mu.Lock()
+					outcome := d.outcomes[i]
+					outcome.StartedAt, outcome.FinishedAt = &started, &finished
+					outcome.DurationSeconds = finished.Sub(started).Seconds()
+					outcome.Status = StatusDeployed
+					if err != nil {
+						outcome.Status = StatusFailed
+						if firstErr == nil {
+							firstErr = &Error{ErrorCategory(err), fmt.Sprintf("Failed: deployment %s for %s to %s as %s \n`%s`", d.image, appName, cluster, *newArn, err.Error())}
+							cancel()
+						}
+					} else {
+						outcome.LiveColour = live
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+
+	feed:
+		for _, i := range w.apps {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+	}
+
+	for n, w := range d.waves {
+		if len(d.waves) > 1 {
+			d.log.Printf("Deploying wave %s: %s", w.name, w.names(o.Apps))
+		}
+
+		updateWave(w)
+		if firstErr != nil {
+			break
+		}
+
+		if n < len(d.waves)-1 {
+			if err := d.afterWave(ctx, w); err != nil {
+				firstErr = err
+				break
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// registerTaskDefinition registers input with the TaskDefinitionTags. Callers
+// without permission to tag get an untagged task definition instead.
+func (d *deployment) registerTaskDefinition(ctx context.Context, input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error) {
+	for key, value := range d.Options.TaskDefinitionTags {
+		input.Tags = append(input.Tags, &ecs.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+
+	res, err := d.svc.RegisterTaskDefinitionWithContext(ctx, input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "AccessDeniedException" && len(input.Tags) > 0 {
+		d.log.Printf("Not allowed to tag the task definition, registering it untagged: %s", aerr.Message())
+		input.Tags = nil
+		res, err = d.svc.RegisterTaskDefinitionWithContext(ctx, input)
+	}
+	return res, err
+}
+
+// updateService points a service at the new task definition
+func (d *deployment) updateService(ctx context.Context, log logger, serviceName string, desiredCount *int64, newArn *string) error {
+	_, err := d.svc.UpdateServiceWithContext(ctx,
+		&ecs.UpdateServiceInput{
+			Cluster:        &d.target.Cluster,
+			Service:        &serviceName,
+			DesiredCount:   desiredCount,
+			TaskDefinition: newArn,
+		})
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.updated = append(d.updated, serviceName)
+	d.mu.Unlock()
+
+	log.Printf("Updated %s service to use new ARN: %s", serviceName, *newArn)
+	return nil
+}
+
+// waitForService waits up to WaitTimeout for a service to become stable
+func (d *deployment) waitForService(ctx context.Context, log logger, appName string, serviceName string) error {
+	timeout := d.Options.WaitTimeout
+	log.Printf("Waiting up to %s for %s to become stable", timeout, serviceName)
+
+	ctx, end := d.phase(ctx, Phase{Name: PhaseStabilise, Target: d.target, App: appName, Service: serviceName})
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := d.svc.WaitUntilServicesStableWithContext(waitCtx,
+		&ecs.DescribeServicesInput{
+			Cluster:  &d.target.Cluster,
+			Services: []*string{&serviceName},
+		},
+		request.WithWaiterMaxAttempts(int(timeout/stabilityPollInterval)+1))
+	end(err)
+	if err != nil {
+		return &Error{CategoryTimeout, fmt.Sprintf("%s did not become stable within %s: %v", serviceName, timeout, err)}
+	}
+
+	log.Printf("Service %s is stable", serviceName)
+	return nil
+}
+
+// rollback points every service this deployment updated back at the task
+// definition it was running before, and switches blue/green pairs back to the
+// colour that was live.
+func (d *deployment) rollback() error {
+	if err := d.revertColours(); err != nil {
+		return err
+	}
+
+	for i := len(d.updated) - 1; i >= 0; i-- {
+		serviceName := d.updated[i]
+		previous := d.previous[serviceName]
+		if previous == nil {
+			continue
+		}
+
+		_, err := d.svc.UpdateServiceWithContext(aws.BackgroundContext(),
+			&ecs.UpdateServiceInput{
+				Cluster:        &d.target.Cluster,
+				Service:        &serviceName,
+				TaskDefinition: previous,
+			})
+		if err != nil {
+			return fmt.Errorf("Failed: rollback of %s on %s in %s to %s \n`%s`", serviceName, d.target.Cluster, d.target.Region, *previous, err.Error())
+		}
+		d.log.Printf("Rolled back %s service to ARN: %s", serviceName, *previous)
+		d.rolledBack = true
+	}
+	d.updated = nil
+	return nil
+}
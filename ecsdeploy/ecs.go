@@ -0,0 +1,58 @@
+package ecsdeploy
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// ECSAPI is the part of the ECS API a deploy uses, in the style of the SDK's
+// ecsiface package. *ecs.ECS satisfies it; tests and simulations can supply
+// their own.
+type ECSAPI interface {
+	DescribeServicesWithContext(aws.Context, *ecs.DescribeServicesInput, ...request.Option) (*ecs.DescribeServicesOutput, error)
+	UpdateServiceWithContext(aws.Context, *ecs.UpdateServiceInput, ...request.Option) (*ecs.UpdateServiceOutput, error)
+	WaitUntilServicesStableWithContext(aws.Context, *ecs.DescribeServicesInput, ...request.WaiterOption) error
+
+	DescribeTaskDefinitionWithContext(aws.Context, *ecs.DescribeTaskDefinitionInput, ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error)
+	RegisterTaskDefinitionWithContext(aws.Context, *ecs.RegisterTaskDefinitionInput, ...request.Option) (*ecs.RegisterTaskDefinitionOutput, error)
+	ListTaskDefinitionsWithContext(aws.Context, *ecs.ListTaskDefinitionsInput, ...request.Option) (*ecs.ListTaskDefinitionsOutput, error)
+
+	ListTasksWithContext(aws.Context, *ecs.ListTasksInput, ...request.Option) (*ecs.ListTasksOutput, error)
+	DescribeTasksWithContext(aws.Context, *ecs.DescribeTasksInput, ...request.Option) (*ecs.DescribeTasksOutput, error)
+
+	ListTagsForResourceWithContext(aws.Context, *ecs.ListTagsForResourceInput, ...request.Option) (*ecs.ListTagsForResourceOutput, error)
+	TagResourceWithContext(aws.Context, *ecs.TagResourceInput, ...request.Option) (*ecs.TagResourceOutput, error)
+	UntagResourceWithContext(aws.Context, *ecs.UntagResourceInput, ...request.Option) (*ecs.UntagResourceOutput, error)
+}
+
+var _ ECSAPI = (*ecs.ECS)(nil)
+
+// DescribeServices looks up the named services on a cluster, keyed by name.
+// Services that can't be found are left out.
+func DescribeServices(ctx aws.Context, svc ECSAPI, cluster string, names []string) (map[string]*ecs.Service, error) {
+	services := map[string]*ecs.Service{}
+
+	// DescribeServices accepts at most 10 services per call
+	for start := 0; start < len(names); start += 10 {
+		end := start + 10
+		if end > len(names) {
+			end = len(names)
+		}
+
+		input := &ecs.DescribeServicesInput{Cluster: &cluster}
+		for _, name := range names[start:end] {
+			name := name
+			input.Services = append(input.Services, &name)
+		}
+
+		res, err := svc.DescribeServicesWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range res.Services {
+			services[*s.ServiceName] = s
+		}
+	}
+	return services, nil
+}
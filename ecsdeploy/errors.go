@@ -0,0 +1,30 @@
+package ecsdeploy
+
+// Categories of failure, so that callers can tell why a deploy failed
+const (
+	CategoryBadInput   = "bad_input"
+	CategoryAWS        = "aws_api_error"
+	CategoryTimeout    = "stabilisation_timeout"
+	CategoryLockHeld   = "lock_held"
+	CategoryAborted    = "aborted"
+	CategoryRolledBack = "rolled_back"
+)
+
+// Error is a failure along with the category it falls under
+type Error struct {
+	Category string
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorCategory returns the category of err. Anything that wasn't categorised
+// where it happened came back from AWS.
+func ErrorCategory(err error) string {
+	if e, ok := err.(*Error); ok {
+		return e.Category
+	}
+	return CategoryAWS
+}
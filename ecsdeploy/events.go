@@ -0,0 +1,56 @@
+package ecsdeploy
+
+import (
+	"context"
+	"fmt"
+)
+
+// Event is a progress message from a deploy
+type Event struct {
+	Target Target
+	// Service is set on messages about one of several services being updated
+	// at the same time, so that they can be told apart
+	Service string
+	Message string
+}
+
+// Phases of a deploy reported to Deployer.Phase
+const (
+	PhaseTarget    = "target"
+	PhaseRegister  = "register"
+	PhaseCanary    = "canary"
+	PhaseUpdate    = "update"
+	PhaseStabilise = "stabilise"
+	PhaseRollback  = "rollback"
+)
+
+// Phase is a timed step of the deploy to a target
+type Phase struct {
+	Name   string
+	Target Target
+	// App and Service are set on phases concerning a single service
+	App     string
+	Service string
+}
+
+// logger sends progress events for a target
+type logger struct {
+	dep     *Deployer
+	target  Target
+	service string
+}
+
+func (l logger) Printf(format string, args ...interface{}) {
+	if l.dep.OnEvent != nil {
+		l.dep.OnEvent(Event{Target: l.target, Service: l.service, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// phase starts a phase, returning the context to run it in and the function
+// to call with its outcome
+func (dep *Deployer) phase(ctx context.Context, p Phase) (context.Context, func(error)) {
+	if dep.Phase == nil {
+		return ctx, func(error) {}
+	}
+	return dep.Phase(ctx, p)
+}
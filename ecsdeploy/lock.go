@@ -0,0 +1,204 @@
+package ecsdeploy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// The lock is stored as tags on the service so that every pipeline deploying
+// to it can see it without any extra infrastructure. ECS tag values can't hold
+// separators like ';', hence one tag per field.
+const (
+	LockOwnerTag   = "go-ecs-deploy:lock-owner"
+	LockExpiresTag = "go-ecs-deploy:lock-expires"
+	LockIDTag      = "go-ecs-deploy:lock-id"
+)
+
+// lockPollInterval is how often a held lock is checked with WaitForLock
+const lockPollInterval = 10 * time.Second
+
+// serviceLock is the advisory deploy lock found on a service
+type serviceLock struct {
+	owner   string
+	expires time.Time
+	id      string
+}
+
+func (l *serviceLock) String() string {
+	return fmt.Sprintf("%s (deploy %s) until %s", l.owner, l.id, l.expires.Format(time.RFC3339))
+}
+
+// readLock returns the lock currently held on a service, or nil if there is
+// none or it has expired.
+func readLock(ctx context.Context, svc ECSAPI, serviceARN string) (*serviceLock, error) {
+	res, err := svc.ListTagsForResourceWithContext(ctx, &ecs.ListTagsForResourceInput{ResourceArn: &serviceARN})
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &serviceLock{}
+	for _, tag := range res.Tags {
+		switch *tag.Key {
+		case LockOwnerTag:
+			lock.owner = *tag.Value
+		case LockIDTag:
+			lock.id = *tag.Value
+		case LockExpiresTag:
+			lock.expires, _ = time.Parse(time.RFC3339, *tag.Value)
+		}
+	}
+
+	if lock.id == "" || time.Now().After(lock.expires) {
+		return nil, nil
+	}
+	return lock, nil
+}
+
+// lock takes the deploy lock on every service about to be updated. Locks that
+// are already held by another deploy are waited on for up to WaitForLock, or
+// taken over with BreakLock. The locks are renewed until unlock, so that a
+// deploy taking longer than LockTTL keeps them.
+func (d *deployment) lock(ctx context.Context, services map[string]*ecs.Service, names []string) error {
+	defer d.keepLocked(ctx)
+
+	for _, name := range names {
+		service, ok := services[name]
+		if !ok {
+			continue
+		}
+		if err := d.lockService(ctx, *service.ServiceArn); err != nil {
+			return &Error{ErrorCategory(err), fmt.Sprintf("Failed: unable to lock %s on %s \n`%s`", name, d.target.Cluster, err.Error())}
+		}
+	}
+	return nil
+}
+
+// keepLocked renews the locks held every third of LockTTL until unlock
+func (d *deployment) keepLocked(ctx context.Context) {
+	stop, done := make(chan struct{}), make(chan struct{})
+	d.stopRenewing = func() {
+		close(stop)
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			case <-time.After(d.Options.LockTTL / 3):
+			}
+			d.renewLocks(ctx)
+		}
+	}()
+}
+
+// renewLocks pushes back the expiry of every lock this deployment still holds
+func (d *deployment) renewLocks(ctx context.Context) {
+	o := d.Options
+	for _, serviceARN := range d.locked {
+		held, err := readLock(ctx, d.svc, serviceARN)
+		if err == nil && (held == nil || held.id != o.DeployID) {
+			// broken or expired, taking it back could trample another deploy
+			d.log.Printf("Lost the lock on %s", serviceARN)
+			continue
+		}
+
+		_, err = d.svc.TagResourceWithContext(ctx, &ecs.TagResourceInput{
+			ResourceArn: aws.String(serviceARN),
+			Tags: []*ecs.Tag{
+				{Key: aws.String(LockExpiresTag), Value: aws.String(time.Now().Add(o.LockTTL).UTC().Format(time.RFC3339))},
+			},
+		})
+		if err != nil {
+			d.log.Printf("Unable to renew lock on %s: %v", serviceARN, err)
+		}
+	}
+}
+
+func (d *deployment) lockService(ctx context.Context, serviceARN string) error {
+	o := d.Options
+	deadline := time.Now().Add(o.WaitForLock)
+
+	for {
+		held, err := readLock(ctx, d.svc, serviceARN)
+		if err != nil {
+			return err
+		}
+
+		if held != nil && held.id != o.DeployID {
+			switch {
+			case o.BreakLock:
+				d.log.Printf("Breaking lock held by %s", held)
+			case time.Now().Before(deadline):
+				d.log.Printf("Waiting for lock held by %s", held)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(lockPollInterval):
+				}
+				continue
+			default:
+				return &Error{CategoryLockHeld, fmt.Sprintf("locked by %s", held)}
+			}
+		}
+
+		_, err = d.svc.TagResourceWithContext(ctx, &ecs.TagResourceInput{
+			ResourceArn: &serviceARN,
+			Tags: []*ecs.Tag{
+				{Key: aws.String(LockOwnerTag), Value: aws.String(o.Owner)},
+				{Key: aws.String(LockExpiresTag), Value: aws.String(time.Now().Add(o.LockTTL).UTC().Format(time.RFC3339))},
+				{Key: aws.String(LockIDTag), Value: aws.String(o.DeployID)},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		// Another deploy may have tagged the service at the same time, in which
+		// case whoever wrote last holds the lock
+		held, err = readLock(ctx, d.svc, serviceARN)
+		if err != nil {
+			return err
+		}
+		if held == nil || held.id != o.DeployID {
+			continue
+		}
+
+		d.locked = append(d.locked, serviceARN)
+		return nil
+	}
+}
+
+// unlock releases every lock this deployment still holds
+func (d *deployment) unlock() {
+	if d.stopRenewing != nil {
+		d.stopRenewing()
+		d.stopRenewing = nil
+	}
+
+	ctx := aws.BackgroundContext()
+	for _, serviceARN := range d.locked {
+		held, err := readLock(ctx, d.svc, serviceARN)
+		if err == nil && (held == nil || held.id != d.Options.DeployID) {
+			// someone broke our lock, leave theirs alone
+			continue
+		}
+
+		_, err = d.svc.UntagResourceWithContext(ctx, &ecs.UntagResourceInput{
+			ResourceArn: aws.String(serviceARN),
+			TagKeys:     aws.StringSlice([]string{LockOwnerTag, LockExpiresTag, LockIDTag}),
+		})
+		if err != nil {
+			d.log.Printf("Unable to release lock on %s: %v", serviceARN, err)
+		}
+	}
+	d.locked = nil
+}
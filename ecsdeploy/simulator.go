@@ -0,0 +1,625 @@
+package ecsdeploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// Simulator defaults
+const (
+	DefaultSimulatedAccountID  = "123456789012"
+	DefaultSimulatedStartDelay = 2 * time.Second
+)
+
+// WaitUntilServicesStable looks again every simulatorPollInterval, or sooner
+// when tasks start quicker than that, but no more often than
+// minSimulatorPollInterval
+const (
+	simulatorPollInterval    = time.Second
+	minSimulatorPollInterval = 10 * time.Millisecond
+)
+
+// Fixture is the starting state of a Simulator, usually read from JSON with
+// LoadFixture.
+type Fixture struct {
+	// AccountID is used in ARNs, defaulting to DefaultSimulatedAccountID
+	AccountID string `json:"account_id"`
+	// CallerARN is who a simulated deploy runs as
+	CallerARN string `json:"caller_arn"`
+	// Clusters are keyed by name
+	Clusters map[string]FixtureCluster `json:"clusters"`
+	// TaskDefinitions are in the form aws ecs describe-task-definition prints
+	// them. Services refer to them as family:revision.
+	TaskDefinitions []*ecs.TaskDefinition `json:"task_definitions"`
+	// StartDelay is how long a task takes to start, e.g. "10s"
+	StartDelay string `json:"start_delay"`
+	// Failures are injected into the simulation
+	Failures SimulatedFailures `json:"failures"`
+	// Seed makes the random task failures repeatable
+	Seed int64 `json:"seed"`
+}
+
+// FixtureCluster is a cluster and the services on it
+type FixtureCluster struct {
+	Services []FixtureService `json:"services"`
+}
+
+// FixtureService is a service, which starts with DesiredCount tasks running
+type FixtureService struct {
+	Name string `json:"name"`
+	// TaskDefinition is family:revision or an ARN
+	TaskDefinition string            `json:"task_definition"`
+	DesiredCount   int64             `json:"desired_count"`
+	Tags           map[string]string `json:"tags"`
+}
+
+// SimulatedFailures says what should go wrong in a simulation
+type SimulatedFailures struct {
+	// TaskFailureRate is the chance, from 0 to 1, that a task stops instead of starting
+	TaskFailureRate float64 `json:"task_failure_rate"`
+	// Images are patterns of images whose tasks fail, where * matches anything
+	Images []string `json:"images"`
+	// CrashAfter is how long the tasks of those images run before stopping,
+	// e.g. "30s". By default they never start.
+	CrashAfter string `json:"crash_after"`
+	// Errors are returned from API calls
+	Errors []SimulatedError `json:"errors"`
+
+	crashAfter time.Duration
+}
+
+// SimulatedError fails an API call, e.g. UpdateService, with an AWS error code
+type SimulatedError struct {
+	Call    string `json:"call"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Count is how many calls fail, or 0 for all of them
+	Count int `json:"count"`
+}
+
+// LoadFixture reads a JSON fixture
+func LoadFixture(path string) (*Fixture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open fixture %s: %v", path, err)
+	}
+	defer f.Close()
+
+	fixture := &Fixture{}
+	if err := json.NewDecoder(f).Decode(fixture); err != nil {
+		return nil, fmt.Errorf("unable to parse fixture %s: %v", path, err)
+	}
+	return fixture, nil
+}
+
+// Simulator is an in-memory stand-in for ECS in one region, for rehearsing
+// deploys without touching AWS. Services run tasks: updating one starts tasks
+// on the new task definition, which are RUNNING after the start delay unless
+// a failure is injected, and once enough are running the old tasks stop.
+//
+// It implements ECSAPI, as well as RunTask.
+type Simulator struct {
+	region     string
+	accountID  string
+	startDelay time.Duration
+	failures   SimulatedFailures
+
+	mu              sync.Mutex
+	rand            *rand.Rand
+	clusters        map[string]*simCluster
+	taskDefinitions map[string]*ecs.TaskDefinition
+	tags            map[string]map[string]string
+	failed          map[int]int
+	ids             int
+
+	// clusterNames are sorted, so that a seeded simulation always happens in
+	// the same order
+	clusterNames []string
+}
+
+type simCluster struct {
+	arn      string
+	services map[string]*simService
+	tasks    []*simTask
+
+	// serviceNames are sorted, like Simulator.clusterNames
+	serviceNames []string
+}
+
+type simService struct {
+	arn  string
+	name string
+	// deployments are oldest first, so the last is the primary
+	deployments []*simDeployment
+}
+
+type simDeployment struct {
+	id             string
+	taskDefinition string
+	desiredCount   int64
+	createdAt      time.Time
+	updatedAt      time.Time
+}
+
+var _ ECSAPI = (*Simulator)(nil)
+
+// NewSimulator returns a Simulator for region in the state the fixture
+// describes, with each service's tasks already running.
+func NewSimulator(region string, f *Fixture) (*Simulator, error) {
+	s := &Simulator{
+		region:          region,
+		accountID:       f.AccountID,
+		startDelay:      DefaultSimulatedStartDelay,
+		failures:        f.Failures,
+		rand:            rand.New(rand.NewSource(f.Seed)),
+		clusters:        map[string]*simCluster{},
+		taskDefinitions: map[string]*ecs.TaskDefinition{},
+		tags:            map[string]map[string]string{},
+		failed:          map[int]int{},
+	}
+	if s.accountID == "" {
+		s.accountID = DefaultSimulatedAccountID
+	}
+	if f.Seed == 0 {
+		s.rand.Seed(time.Now().UnixNano())
+	}
+	if f.StartDelay != "" {
+		delay, err := time.ParseDuration(f.StartDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start_delay %q: %v", f.StartDelay, err)
+		}
+		s.startDelay = delay
+	}
+	if f.Failures.CrashAfter != "" {
+		crashAfter, err := time.ParseDuration(f.Failures.CrashAfter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid crash_after %q: %v", f.Failures.CrashAfter, err)
+		}
+		s.failures.crashAfter = crashAfter
+	}
+
+	for _, td := range f.TaskDefinitions {
+		if td.Family == nil || len(td.ContainerDefinitions) == 0 {
+			return nil, fmt.Errorf("task definitions need a family and container definitions")
+		}
+		td = awsutil.CopyOf(td).(*ecs.TaskDefinition)
+		if td.Revision == nil {
+			td.Revision = aws.Int64(s.latestRevision(*td.Family) + 1)
+		}
+		if td.Status == nil {
+			td.Status = aws.String(ecs.TaskDefinitionStatusActive)
+		}
+		td.TaskDefinitionArn = aws.String(s.arn(fmt.Sprintf("task-definition/%s:%d", *td.Family, *td.Revision)))
+		s.taskDefinitions[*td.TaskDefinitionArn] = td
+	}
+
+	for clusterName := range f.Clusters {
+		s.clusterNames = append(s.clusterNames, clusterName)
+	}
+	sort.Strings(s.clusterNames)
+
+	now := time.Now().UTC()
+	for _, clusterName := range s.clusterNames {
+		fc := f.Clusters[clusterName]
+		c := &simCluster{arn: s.arn("cluster/" + clusterName), services: map[string]*simService{}}
+		s.clusters[clusterName] = c
+
+		for _, fs := range fc.Services {
+			td, err := s.taskDefinition(fs.TaskDefinition)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: unknown task definition %s", fs.Name, fs.TaskDefinition)
+			}
+
+			svc := &simService{arn: s.arn(fmt.Sprintf("service/%s/%s", clusterName, fs.Name)), name: fs.Name}
+			svc.deployments = []*simDeployment{s.newDeployment(*td.TaskDefinitionArn, fs.DesiredCount, now)}
+			c.services[fs.Name] = svc
+			// Each simulator tags its own copy, or locks and colours set in one
+			// region would show up in the others
+			for key, value := range fs.Tags {
+				if s.tags[svc.arn] == nil {
+					s.tags[svc.arn] = map[string]string{}
+				}
+				s.tags[svc.arn][key] = value
+			}
+
+			for n := int64(0); n < fs.DesiredCount; n++ {
+				t := s.launch(c, td, "service:"+fs.Name, svc.deployments[0].id, now)
+				t.fails = false
+				s.start(t, now)
+			}
+		}
+
+		for name := range c.services {
+			c.serviceNames = append(c.serviceNames, name)
+		}
+		sort.Strings(c.serviceNames)
+	}
+	return s, nil
+}
+
+// arn is the ARN of a resource in the simulated region and account
+func (s *Simulator) arn(resource string) string {
+	return fmt.Sprintf("arn:aws:ecs:%s:%s:%s", s.region, s.accountID, resource)
+}
+
+// nextID returns a new unique ID
+func (s *Simulator) nextID() string {
+	s.ids++
+	return fmt.Sprintf("%08x%016x", s.ids, s.rand.Int63())
+}
+
+// inject returns the error to fail call with, if there is one
+func (s *Simulator) inject(call string) error {
+	for i, e := range s.failures.Errors {
+		if e.Call != call || (e.Count > 0 && s.failed[i] >= e.Count) {
+			continue
+		}
+		s.failed[i]++
+
+		msg := e.Message
+		if msg == "" {
+			msg = "simulated failure"
+		}
+		return awserr.New(e.Code, msg, nil)
+	}
+	return nil
+}
+
+// cluster finds a cluster by name or ARN
+func (s *Simulator) cluster(ref *string) (*simCluster, error) {
+	name := aws.StringValue(ref)
+	if name == "" {
+		name = "default"
+	}
+	if c := s.clusters[name[strings.LastIndex(name, "/")+1:]]; c != nil {
+		return c, nil
+	}
+	return nil, awserr.New(ecs.ErrCodeClusterNotFoundException, "Cluster not found.", nil)
+}
+
+// service finds a service on a cluster by name or ARN
+func (c *simCluster) service(ref string) *simService {
+	return c.services[ref[strings.LastIndex(ref, "/")+1:]]
+}
+
+// taskDefinition finds a task definition by ARN, family:revision or family,
+// which is the latest active revision.
+func (s *Simulator) taskDefinition(ref string) (*ecs.TaskDefinition, error) {
+	if !strings.HasPrefix(ref, "arn:") {
+		if !strings.Contains(ref, ":") {
+			ref = fmt.Sprintf("%s:%d", ref, s.latestRevision(ref))
+		}
+		ref = s.arn("task-definition/" + ref)
+	}
+	if td := s.taskDefinitions[ref]; td != nil {
+		return td, nil
+	}
+	return nil, awserr.New(ecs.ErrCodeClientException, "Unable to describe task definition.", nil)
+}
+
+// latestRevision is the highest active revision of a family, or 0
+func (s *Simulator) latestRevision(family string) int64 {
+	var latest int64
+	for _, td := range s.taskDefinitions {
+		if *td.Family == family && *td.Status == ecs.TaskDefinitionStatusActive && *td.Revision > latest {
+			latest = *td.Revision
+		}
+	}
+	return latest
+}
+
+func (s *Simulator) newDeployment(taskDefinition string, desiredCount int64, now time.Time) *simDeployment {
+	return &simDeployment{
+		id:             fmt.Sprintf("ecs-svc/%019d", s.rand.Int63()),
+		taskDefinition: taskDefinition,
+		desiredCount:   desiredCount,
+		createdAt:      now,
+		updatedAt:      now,
+	}
+}
+
+// describeService reports a service as ECS does
+func (s *Simulator) describeService(c *simCluster, svc *simService) *ecs.Service {
+	primary := svc.deployments[len(svc.deployments)-1]
+	out := &ecs.Service{
+		ServiceArn:     aws.String(svc.arn),
+		ServiceName:    aws.String(svc.name),
+		ClusterArn:     aws.String(c.arn),
+		Status:         aws.String("ACTIVE"),
+		TaskDefinition: aws.String(primary.taskDefinition),
+		DesiredCount:   aws.Int64(primary.desiredCount),
+		RunningCount:   aws.Int64(0),
+		PendingCount:   aws.Int64(0),
+		CreatedAt:      aws.Time(svc.deployments[0].createdAt),
+	}
+
+	for i := len(svc.deployments) - 1; i >= 0; i-- {
+		d := svc.deployments[i]
+		status := "ACTIVE"
+		if d == primary {
+			status = "PRIMARY"
+		}
+
+		var running, pending int64
+		for _, t := range c.tasks {
+			if aws.StringValue(t.task.StartedBy) != d.id || *t.task.DesiredStatus != ecs.DesiredStatusRunning {
+				continue
+			}
+			if *t.task.LastStatus == ecs.DesiredStatusRunning {
+				running++
+			} else {
+				pending++
+			}
+		}
+		*out.RunningCount += running
+		*out.PendingCount += pending
+
+		out.Deployments = append(out.Deployments, &ecs.Deployment{
+			Id:             aws.String(d.id),
+			Status:         aws.String(status),
+			TaskDefinition: aws.String(d.taskDefinition),
+			DesiredCount:   aws.Int64(d.desiredCount),
+			RunningCount:   aws.Int64(running),
+			PendingCount:   aws.Int64(pending),
+			CreatedAt:      aws.Time(d.createdAt),
+			UpdatedAt:      aws.Time(d.updatedAt),
+		})
+	}
+	return out
+}
+
+// DescribeServicesWithContext describes services, listing those not found as failures
+func (s *Simulator) DescribeServicesWithContext(ctx aws.Context, input *ecs.DescribeServicesInput, opts ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inject("DescribeServices"); err != nil {
+		return nil, err
+	}
+	s.advance(time.Now().UTC())
+
+	c, err := s.cluster(input.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ecs.DescribeServicesOutput{}
+	for _, name := range input.Services {
+		if svc := c.service(*name); svc != nil {
+			out.Services = append(out.Services, s.describeService(c, svc))
+		} else {
+			out.Failures = append(out.Failures, &ecs.Failure{
+				Arn:    aws.String(s.arn(fmt.Sprintf("service/%s", *name))),
+				Reason: aws.String("MISSING"),
+			})
+		}
+	}
+	return out, nil
+}
+
+// UpdateServiceWithContext changes a service's desired count and starts a
+// new deployment of its task definition
+func (s *Simulator) UpdateServiceWithContext(ctx aws.Context, input *ecs.UpdateServiceInput, opts ...request.Option) (*ecs.UpdateServiceOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inject("UpdateService"); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	s.advance(now)
+
+	c, err := s.cluster(input.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	svc := c.service(aws.StringValue(input.Service))
+	if svc == nil {
+		return nil, awserr.New(ecs.ErrCodeServiceNotFoundException, "Service not found.", nil)
+	}
+
+	primary := svc.deployments[len(svc.deployments)-1]
+	desiredCount := primary.desiredCount
+	if input.DesiredCount != nil {
+		desiredCount = *input.DesiredCount
+	}
+
+	taskDefinition := primary.taskDefinition
+	if input.TaskDefinition != nil {
+		td, err := s.taskDefinition(*input.TaskDefinition)
+		if err != nil {
+			return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "TaskDefinition not found.", nil)
+		}
+		taskDefinition = *td.TaskDefinitionArn
+	}
+
+	if taskDefinition != primary.taskDefinition || aws.BoolValue(input.ForceNewDeployment) {
+		svc.deployments = append(svc.deployments, s.newDeployment(taskDefinition, desiredCount, now))
+	} else {
+		primary.desiredCount, primary.updatedAt = desiredCount, now
+	}
+	s.advance(now)
+
+	return &ecs.UpdateServiceOutput{Service: s.describeService(c, svc)}, nil
+}
+
+// RegisterTaskDefinitionWithContext registers the next revision of a family
+func (s *Simulator) RegisterTaskDefinitionWithContext(ctx aws.Context, input *ecs.RegisterTaskDefinitionInput, opts ...request.Option) (*ecs.RegisterTaskDefinitionOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inject("RegisterTaskDefinition"); err != nil {
+		return nil, err
+	}
+	if aws.StringValue(input.Family) == "" || len(input.ContainerDefinitions) == 0 {
+		return nil, awserr.New(ecs.ErrCodeClientException, "Family and container definitions are required.", nil)
+	}
+
+	td := &ecs.TaskDefinition{}
+	awsutil.Copy(td, input)
+	td.Revision = aws.Int64(1)
+	for _, other := range s.taskDefinitions {
+		if *other.Family == *td.Family && *other.Revision >= *td.Revision {
+			td.Revision = aws.Int64(*other.Revision + 1)
+		}
+	}
+	td.Status = aws.String(ecs.TaskDefinitionStatusActive)
+	td.TaskDefinitionArn = aws.String(s.arn(fmt.Sprintf("task-definition/%s:%d", *td.Family, *td.Revision)))
+	s.taskDefinitions[*td.TaskDefinitionArn] = td
+
+	if len(input.Tags) > 0 {
+		tags := map[string]string{}
+		for _, tag := range input.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		s.tags[*td.TaskDefinitionArn] = tags
+	}
+
+	return &ecs.RegisterTaskDefinitionOutput{
+		TaskDefinition: awsutil.CopyOf(td).(*ecs.TaskDefinition),
+		Tags:           s.tagList(*td.TaskDefinitionArn),
+	}, nil
+}
+
+// DescribeTaskDefinitionWithContext describes a task definition, with its
+// tags if asked for
+func (s *Simulator) DescribeTaskDefinitionWithContext(ctx aws.Context, input *ecs.DescribeTaskDefinitionInput, opts ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inject("DescribeTaskDefinition"); err != nil {
+		return nil, err
+	}
+
+	td, err := s.taskDefinition(aws.StringValue(input.TaskDefinition))
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ecs.DescribeTaskDefinitionOutput{TaskDefinition: awsutil.CopyOf(td).(*ecs.TaskDefinition)}
+	for _, field := range input.Include {
+		if *field == ecs.TaskDefinitionFieldTags {
+			out.Tags = s.tagList(*td.TaskDefinitionArn)
+		}
+	}
+	return out, nil
+}
+
+// ListTaskDefinitionsWithContext lists task definition ARNs by family prefix
+// and status, a page at a time
+func (s *Simulator) ListTaskDefinitionsWithContext(ctx aws.Context, input *ecs.ListTaskDefinitionsInput, opts ...request.Option) (*ecs.ListTaskDefinitionsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inject("ListTaskDefinitions"); err != nil {
+		return nil, err
+	}
+
+	status := aws.StringValue(input.Status)
+	if status == "" {
+		status = ecs.TaskDefinitionStatusActive
+	}
+
+	var tds []*ecs.TaskDefinition
+	for _, td := range s.taskDefinitions {
+		if *td.Status == status && strings.HasPrefix(*td.Family, aws.StringValue(input.FamilyPrefix)) {
+			tds = append(tds, td)
+		}
+	}
+	sort.Slice(tds, func(i, j int) bool {
+		if *tds[i].Family != *tds[j].Family {
+			return *tds[i].Family < *tds[j].Family
+		}
+		return *tds[i].Revision < *tds[j].Revision
+	})
+	if aws.StringValue(input.Sort) == ecs.SortOrderDesc {
+		for i, j := 0, len(tds)-1; i < j; i, j = i+1, j-1 {
+			tds[i], tds[j] = tds[j], tds[i]
+		}
+	}
+
+	out := &ecs.ListTaskDefinitionsOutput{}
+	for _, td := range page(len(tds), input.MaxResults, input.NextToken, &out.NextToken) {
+		out.TaskDefinitionArns = append(out.TaskDefinitionArns, aws.String(*tds[td].TaskDefinitionArn))
+	}
+	return out, nil
+}
+
+// page returns the indexes of the page of n results starting at token, and
+// sets next to the token of the following page
+func page(n int, maxResults *int64, token *string, next **string) []int {
+	size := 100
+	if maxResults != nil && *maxResults > 0 {
+		size = int(*maxResults)
+	}
+	start, _ := strconv.Atoi(aws.StringValue(token))
+
+	var indexes []int
+	for i := start; i < n && i < start+size; i++ {
+		indexes = append(indexes, i)
+	}
+	if start+size < n {
+		*next = aws.String(strconv.Itoa(start + size))
+	}
+	return indexes
+}
+
+// ListTagsForResourceWithContext lists the tags on a resource
+func (s *Simulator) ListTagsForResourceWithContext(ctx aws.Context, input *ecs.ListTagsForResourceInput, opts ...request.Option) (*ecs.ListTagsForResourceOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inject("ListTagsForResource"); err != nil {
+		return nil, err
+	}
+	return &ecs.ListTagsForResourceOutput{Tags: s.tagList(aws.StringValue(input.ResourceArn))}, nil
+}
+
+// TagResourceWithContext adds or replaces tags on a resource
+func (s *Simulator) TagResourceWithContext(ctx aws.Context, input *ecs.TagResourceInput, opts ...request.Option) (*ecs.TagResourceOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inject("TagResource"); err != nil {
+		return nil, err
+	}
+
+	arn := aws.StringValue(input.ResourceArn)
+	if s.tags[arn] == nil {
+		s.tags[arn] = map[string]string{}
+	}
+	for _, tag := range input.Tags {
+		s.tags[arn][aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return &ecs.TagResourceOutput{}, nil
+}
+
+// UntagResourceWithContext removes tags from a resource
+func (s *Simulator) UntagResourceWithContext(ctx aws.Context, input *ecs.UntagResourceInput, opts ...request.Option) (*ecs.UntagResourceOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inject("UntagResource"); err != nil {
+		return nil, err
+	}
+
+	for _, key := range input.TagKeys {
+		delete(s.tags[aws.StringValue(input.ResourceArn)], aws.StringValue(key))
+	}
+	return &ecs.UntagResourceOutput{}, nil
+}
+
+// tagList returns a resource's tags in key order
+func (s *Simulator) tagList(arn string) []*ecs.Tag {
+	var tags []*ecs.Tag
+	for key, value := range s.tags[arn] {
+		tags = append(tags, &ecs.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	sort.Slice(tags, func(i, j int) bool { return *tags[i].Key < *tags[j].Key })
+	return tags
+}
@@ -0,0 +1,317 @@
+package ecsdeploy
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// simTask is a task and what is going to happen to it
+type simTask struct {
+	task    *ecs.Task
+	startAt time.Time
+	// fails is set for tasks that stop, at stopAt if they get to run at all
+	fails  bool
+	stopAt time.Time
+}
+
+// launch starts a task of td on a cluster, which is PENDING until the start
+// delay has passed
+func (s *Simulator) launch(c *simCluster, td *ecs.TaskDefinition, group string, startedBy string, now time.Time) *simTask {
+	t := &simTask{
+		task: &ecs.Task{
+			TaskArn:           aws.String(s.arn("task/" + s.nextID())),
+			ClusterArn:        aws.String(c.arn),
+			TaskDefinitionArn: aws.String(*td.TaskDefinitionArn),
+			Group:             aws.String(group),
+			LastStatus:        aws.String("PENDING"),
+			DesiredStatus:     aws.String(ecs.DesiredStatusRunning),
+			CreatedAt:         aws.Time(now),
+			Cpu:               td.Cpu,
+			Memory:            td.Memory,
+		},
+		startAt: now.Add(s.startDelay),
+		fails:   s.shouldFail(td),
+	}
+	if startedBy != "" {
+		t.task.StartedBy = aws.String(startedBy)
+	}
+	for _, cd := range td.ContainerDefinitions {
+		t.task.Containers = append(t.task.Containers, &ecs.Container{
+			ContainerArn: aws.String(s.arn("container/" + s.nextID())),
+			TaskArn:      t.task.TaskArn,
+			Name:         cd.Name,
+			LastStatus:   aws.String("PENDING"),
+		})
+	}
+	if t.fails && s.failures.crashAfter > 0 {
+		t.stopAt = t.startAt.Add(s.failures.crashAfter)
+	}
+
+	c.tasks = append(c.tasks, t)
+	return t
+}
+
+// shouldFail decides whether a new task of td is going to fail
+func (s *Simulator) shouldFail(td *ecs.TaskDefinition) bool {
+	for _, cd := range td.ContainerDefinitions {
+		for _, pattern := range s.failures.Images {
+			if matchImage(pattern, aws.StringValue(cd.Image)) {
+				return true
+			}
+		}
+	}
+	return s.failures.TaskFailureRate > 0 && s.rand.Float64() < s.failures.TaskFailureRate
+}
+
+// matchImage reports whether an image matches a pattern, in which * matches
+// anything
+func matchImage(pattern string, image string) bool {
+	expr := strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1)
+	ok, _ := regexp.MatchString("^"+expr+"$", image)
+	return ok
+}
+
+// start moves a pending task on to RUNNING, or stops it if it fails to start
+func (s *Simulator) start(t *simTask, at time.Time) {
+	if t.fails && t.stopAt.IsZero() {
+		s.stop(t, at, "Essential container in task exited", ecs.TaskStopCodeEssentialContainerExited, 1)
+		return
+	}
+
+	t.task.LastStatus = aws.String(ecs.DesiredStatusRunning)
+	t.task.StartedAt = aws.Time(at)
+	for _, container := range t.task.Containers {
+		container.LastStatus = aws.String(ecs.DesiredStatusRunning)
+	}
+}
+
+// stop stops a task, with the exit code of its containers
+func (s *Simulator) stop(t *simTask, at time.Time, reason string, code string, exitCode int64) {
+	t.task.DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+	t.task.LastStatus = aws.String(ecs.DesiredStatusStopped)
+	t.task.StoppingAt = aws.Time(at)
+	t.task.StoppedAt = aws.Time(at)
+	t.task.StoppedReason = aws.String(reason)
+	if code != "" {
+		t.task.StopCode = aws.String(code)
+	}
+	for _, container := range t.task.Containers {
+		container.LastStatus = aws.String(ecs.DesiredStatusStopped)
+		container.ExitCode = aws.Int64(exitCode)
+	}
+}
+
+// advance brings the simulation up to now: tasks due to start or fail do so,
+// and each service's scheduler replaces stopped tasks and drains old
+// deployments once the primary one is running.
+func (s *Simulator) advance(now time.Time) {
+	for _, name := range s.clusterNames {
+		c := s.clusters[name]
+		for _, t := range c.tasks {
+			switch {
+			case *t.task.LastStatus == "PENDING" && !t.startAt.After(now):
+				s.start(t, t.startAt)
+			case *t.task.LastStatus == ecs.DesiredStatusRunning && t.fails && !t.stopAt.After(now):
+				s.stop(t, t.stopAt, "Essential container in task exited", ecs.TaskStopCodeEssentialContainerExited, 1)
+			}
+		}
+
+		for _, name := range c.serviceNames {
+			s.schedule(c, c.services[name], now)
+		}
+	}
+}
+
+// schedule does what the ECS service scheduler would for one service
+func (s *Simulator) schedule(c *simCluster, svc *simService, now time.Time) {
+	primary := svc.deployments[len(svc.deployments)-1]
+
+	var live, old []*simTask
+	var running int64
+	for _, t := range c.tasks {
+		if *t.task.Group != "service:"+svc.name || *t.task.DesiredStatus != ecs.DesiredStatusRunning {
+			continue
+		}
+		if aws.StringValue(t.task.StartedBy) != primary.id {
+			old = append(old, t)
+			continue
+		}
+		live = append(live, t)
+		if *t.task.LastStatus == ecs.DesiredStatusRunning {
+			running++
+		}
+	}
+
+	td := s.taskDefinitions[primary.taskDefinition]
+	for n := int64(len(live)); n < primary.desiredCount; n++ {
+		s.launch(c, td, "service:"+svc.name, primary.id, now)
+	}
+	for n := primary.desiredCount; n < int64(len(live)); n++ {
+		s.stop(live[n], now, "Service "+svc.name+" was scaled in", ecs.TaskStopCodeUserInitiated, 0)
+	}
+
+	if len(svc.deployments) > 1 && running >= primary.desiredCount {
+		for _, t := range old {
+			s.stop(t, now, "Scaling activity initiated by (deployment "+primary.id+")", "", 0)
+		}
+		svc.deployments = []*simDeployment{primary}
+	}
+}
+
+// RunTaskWithContext starts standalone tasks of a task definition
+func (s *Simulator) RunTaskWithContext(ctx aws.Context, input *ecs.RunTaskInput, opts ...request.Option) (*ecs.RunTaskOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inject("RunTask"); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	s.advance(now)
+
+	c, err := s.cluster(input.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	td, err := s.taskDefinition(aws.StringValue(input.TaskDefinition))
+	if err != nil {
+		return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "TaskDefinition not found.", nil)
+	}
+
+	group := aws.StringValue(input.Group)
+	if group == "" {
+		group = "family:" + *td.Family
+	}
+
+	out := &ecs.RunTaskOutput{}
+	for n := int64(0); n < aws.Int64Value(input.Count) || n == 0; n++ {
+		t := s.launch(c, td, group, aws.StringValue(input.StartedBy), now)
+		out.Tasks = append(out.Tasks, awsutil.CopyOf(t.task).(*ecs.Task))
+	}
+	return out, nil
+}
+
+// ListTasksWithContext lists the ARNs of tasks on a cluster, in the order
+// they were started
+func (s *Simulator) ListTasksWithContext(ctx aws.Context, input *ecs.ListTasksInput, opts ...request.Option) (*ecs.ListTasksOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inject("ListTasks"); err != nil {
+		return nil, err
+	}
+	s.advance(time.Now().UTC())
+
+	c, err := s.cluster(input.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	desiredStatus := aws.StringValue(input.DesiredStatus)
+	if desiredStatus == "" {
+		desiredStatus = ecs.DesiredStatusRunning
+	}
+
+	var tasks []*ecs.Task
+	for _, t := range c.tasks {
+		switch {
+		case *t.task.DesiredStatus != desiredStatus:
+		case input.ServiceName != nil && *t.task.Group != "service:"+*input.ServiceName:
+		case input.StartedBy != nil && aws.StringValue(t.task.StartedBy) != *input.StartedBy:
+		case input.Family != nil && !strings.Contains(*t.task.TaskDefinitionArn, ":task-definition/"+*input.Family+":"):
+		default:
+			tasks = append(tasks, t.task)
+		}
+	}
+
+	out := &ecs.ListTasksOutput{}
+	for _, i := range page(len(tasks), input.MaxResults, input.NextToken, &out.NextToken) {
+		out.TaskArns = append(out.TaskArns, aws.String(*tasks[i].TaskArn))
+	}
+	return out, nil
+}
+
+// DescribeTasksWithContext describes tasks by ARN or ID, listing those not
+// found as failures
+func (s *Simulator) DescribeTasksWithContext(ctx aws.Context, input *ecs.DescribeTasksInput, opts ...request.Option) (*ecs.DescribeTasksOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inject("DescribeTasks"); err != nil {
+		return nil, err
+	}
+	s.advance(time.Now().UTC())
+
+	c, err := s.cluster(input.Cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ecs.DescribeTasksOutput{}
+tasks:
+	for _, ref := range input.Tasks {
+		for _, t := range c.tasks {
+			if *t.task.TaskArn == *ref || strings.HasSuffix(*t.task.TaskArn, "/"+*ref) {
+				out.Tasks = append(out.Tasks, awsutil.CopyOf(t.task).(*ecs.Task))
+				continue tasks
+			}
+		}
+		out.Failures = append(out.Failures, &ecs.Failure{Arn: aws.String(*ref), Reason: aws.String("MISSING")})
+	}
+	return out, nil
+}
+
+// WaitUntilServicesStableWithContext waits for each service to have a single
+// deployment with all of its tasks running. It gives up after as long as the
+// SDK's waiter would, checking more often so simulations move quickly.
+func (s *Simulator) WaitUntilServicesStableWithContext(ctx aws.Context, input *ecs.DescribeServicesInput, opts ...request.WaiterOption) error {
+	w := request.Waiter{MaxAttempts: 40, Delay: request.ConstantWaiterDelay(15 * time.Second)}
+	w.ApplyOptions(opts...)
+
+	var timeout time.Duration
+	for attempt := 1; attempt < w.MaxAttempts; attempt++ {
+		timeout += w.Delay(attempt)
+	}
+	deadline := time.Now().Add(timeout)
+
+	interval := s.startDelay
+	if interval > simulatorPollInterval {
+		interval = simulatorPollInterval
+	}
+	if interval < minSimulatorPollInterval {
+		interval = minSimulatorPollInterval
+	}
+
+	for {
+		res, err := s.DescribeServicesWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		if len(res.Failures) > 0 {
+			return awserr.New(request.WaiterResourceNotReadyErrorCode, "failed waiting for successful resource state", nil)
+		}
+
+		stable := true
+		for _, svc := range res.Services {
+			if len(svc.Deployments) != 1 || *svc.RunningCount != *svc.DesiredCount {
+				stable = false
+			}
+		}
+		if stable {
+			return nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return awserr.New(request.WaiterResourceNotReadyErrorCode, "exceeded wait attempts", nil)
+		}
+		select {
+		case <-ctx.Done():
+			return awserr.New(request.CanceledErrorCode, "waiter context canceled", ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
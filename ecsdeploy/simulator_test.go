@@ -0,0 +1,174 @@
+package ecsdeploy
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const (
+	testRegion  = "eu-west-1"
+	testCluster = "vend-test"
+)
+
+// testFixture has a web and an api service, a canary and a blue/green pair
+// of web, all running v1. Images tagged bad never start.
+func testFixture() *Fixture {
+	taskDefinition := func(family string) *ecs.TaskDefinition {
+		return &ecs.TaskDefinition{
+			Family: aws.String(family),
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String(family), Image: aws.String("vend/" + family + ":v1")},
+			},
+		}
+	}
+
+	return &Fixture{
+		StartDelay:      "20ms",
+		Seed:            1,
+		Failures:        SimulatedFailures{Images: []string{"*:bad*"}},
+		TaskDefinitions: []*ecs.TaskDefinition{taskDefinition("web"), taskDefinition("api")},
+		Clusters: map[string]FixtureCluster{
+			testCluster: {Services: []FixtureService{
+				{Name: "web-test", TaskDefinition: "web:1", DesiredCount: 2},
+				{Name: "web-test-canary", TaskDefinition: "web:1", DesiredCount: 1},
+				{Name: "api-test", TaskDefinition: "api:1", DesiredCount: 1},
+				{Name: "web-test-blue", TaskDefinition: "web:1", DesiredCount: 2, Tags: map[string]string{LiveColourTag: Blue}},
+				{Name: "web-test-green", TaskDefinition: "web:1", DesiredCount: 0, Tags: map[string]string{LiveColourTag: Blue}},
+			}},
+		},
+	}
+}
+
+// service describes a service on the test cluster
+func service(t *testing.T, s *Simulator, name string) *ecs.Service {
+	t.Helper()
+	services, err := DescribeServices(aws.BackgroundContext(), s, testCluster, []string{name})
+	if err != nil || services[name] == nil {
+		t.Fatalf("unable to describe %s: %v", name, err)
+	}
+	return services[name]
+}
+
+// serviceTags returns the tags on a service on the test cluster
+func serviceTags(t *testing.T, s *Simulator, name string) map[string]string {
+	t.Helper()
+	res, err := s.ListTagsForResourceWithContext(aws.BackgroundContext(), &ecs.ListTagsForResourceInput{ResourceArn: service(t, s, name).ServiceArn})
+	if err != nil {
+		t.Fatalf("unable to list tags of %s: %v", name, err)
+	}
+	tags := map[string]string{}
+	for _, tag := range res.Tags {
+		tags[*tag.Key] = *tag.Value
+	}
+	return tags
+}
+
+// taskDefinitionARN is the ARN of a task definition in the test fixture
+func taskDefinitionARN(ref string) string {
+	return fmt.Sprintf("arn:aws:ecs:%s:%s:task-definition/%s", testRegion, DefaultSimulatedAccountID, ref)
+}
+
+func TestSimulatorTagsArePerRegion(t *testing.T) {
+	f := testFixture()
+	a, err := NewSimulator(testRegion, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSimulator(testRegion, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = a.TagResourceWithContext(aws.BackgroundContext(), &ecs.TagResourceInput{
+		ResourceArn: service(t, a, "web-test-blue").ServiceArn,
+		Tags:        []*ecs.Tag{{Key: aws.String(LiveColourTag), Value: aws.String(Green)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if colour := serviceTags(t, b, "web-test-blue")[LiveColourTag]; colour != Blue {
+		t.Errorf("live colour in the other simulator = %q, want %q", colour, Blue)
+	}
+	if colour := f.Clusters[testCluster].Services[3].Tags[LiveColourTag]; colour != Blue {
+		t.Errorf("live colour in the fixture = %q, want %q", colour, Blue)
+	}
+}
+
+func TestSimulatorStartsTasks(t *testing.T) {
+	s, err := NewSimulator(testRegion, testFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.UpdateServiceWithContext(aws.BackgroundContext(), &ecs.UpdateServiceInput{
+		Cluster:      aws.String(testCluster),
+		Service:      aws.String("web-test"),
+		DesiredCount: aws.Int64(3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending := *service(t, s, "web-test").PendingCount; pending != 1 {
+		t.Errorf("pending tasks = %d, want 1", pending)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if running := *service(t, s, "web-test").RunningCount; running != 3 {
+		t.Errorf("running tasks = %d, want 3", running)
+	}
+}
+
+func TestSimulatorIsRepeatable(t *testing.T) {
+	f := testFixture()
+	f.Failures.TaskFailureRate = 0.5
+	f.Clusters["vend-other"] = f.Clusters[testCluster]
+
+	// run lists every task once tasks have been started on each service
+	run := func() []string {
+		s, err := NewSimulator(testRegion, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := aws.BackgroundContext()
+		for _, cluster := range []string{testCluster, "vend-other"} {
+			for _, name := range []string{"web-test", "api-test", "web-test-green"} {
+				_, err := s.UpdateServiceWithContext(ctx, &ecs.UpdateServiceInput{
+					Cluster:      aws.String(cluster),
+					Service:      aws.String(name),
+					DesiredCount: aws.Int64(3),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		var tasks []string
+		for _, cluster := range []string{testCluster, "vend-other"} {
+			for _, status := range []string{ecs.DesiredStatusRunning, ecs.DesiredStatusStopped} {
+				res, err := s.ListTasksWithContext(ctx, &ecs.ListTasksInput{Cluster: aws.String(cluster), DesiredStatus: aws.String(status)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, arn := range res.TaskArns {
+					tasks = append(tasks, status+" "+*arn)
+				}
+			}
+		}
+		return tasks
+	}
+
+	want := run()
+	for n := 0; n < 4; n++ {
+		if got := run(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("tasks = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package ecsdeploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// wave is a group of apps deployed together, once every earlier wave is stable
+type wave struct {
+	name string
+	// apps are indices into Options.Apps
+	apps    []int
+	pause   time.Duration
+	approve bool
+}
+
+// planWaves splits the apps being deployed into the configured waves. Apps
+// not picked up by any wave go out last. Without any configured waves every
+// app is deployed in a single wave.
+func planWaves(configured []Wave, apps []string) []wave {
+	remaining := make([]int, len(apps))
+	for i := range apps {
+		remaining[i] = i
+	}
+
+	var waves []wave
+	for n, c := range configured {
+		w := wave{name: c.Name, pause: c.Pause, approve: c.Approve}
+		if w.name == "" {
+			w.name = fmt.Sprintf("%d", n+1)
+		}
+
+		switch {
+		case len(c.Apps) > 0:
+			var rest []int
+			for _, i := range remaining {
+				if contains(c.Apps, apps[i]) {
+					w.apps = append(w.apps, i)
+				} else {
+					rest = append(rest, i)
+				}
+			}
+			remaining = rest
+		case c.Percent > 0:
+			// round up, so that a small wave still gets at least one app
+			size := (len(remaining)*c.Percent + 99) / 100
+			if size > len(remaining) {
+				size = len(remaining)
+			}
+			w.apps, remaining = remaining[:size], remaining[size:]
+		default:
+			w.apps, remaining = remaining, nil
+		}
+
+		if len(w.apps) > 0 {
+			waves = append(waves, w)
+		}
+	}
+
+	if len(remaining) > 0 {
+		waves = append(waves, wave{name: "remaining", apps: remaining})
+	}
+	return waves
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// names lists the apps in the wave
+func (w wave) names(apps []string) string {
+	names := make([]string, len(w.apps))
+	for n, i := range w.apps {
+		names[n] = apps[i]
+	}
+	return strings.Join(names, ", ")
+}
+
+// afterWave holds off the next wave for the wave's pause, then asks for
+// approval if the wave requires it.
+func (d *deployment) afterWave(ctx context.Context, w wave) error {
+	if w.pause > 0 {
+		d.log.Printf("Pausing for %s after wave %s", w.pause, w.name)
+		select {
+		case <-ctx.Done():
+			return &Error{CategoryAborted, fmt.Sprintf("Failed: deployment %s to %s stopped while pausing after wave %s: %v", d.image, d.target.Cluster, w.name, ctx.Err())}
+		case <-time.After(w.pause):
+		}
+	}
+
+	if !w.approve || (d.Approve != nil && d.Approve(ctx, d.target, w.name)) {
+		return nil
+	}
+	return &Error{CategoryAborted, fmt.Sprintf("Failed: deployment %s to %s stopped after wave %s, next wave not approved", d.image, d.target.Cluster, w.name)}
+}
@@ -0,0 +1,73 @@
+package ecsdeploy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanWaves(t *testing.T) {
+	apps := []string{"a", "b", "c", "d"}
+
+	tests := []struct {
+		name  string
+		waves []Wave
+		want  map[string][]int
+		order []string
+	}{
+		{
+			name:  "no waves",
+			want:  map[string][]int{"remaining": {0, 1, 2, 3}},
+			order: []string{"remaining"},
+		},
+		{
+			name:  "apps",
+			waves: []Wave{{Name: "first", Apps: []string{"c", "a"}}},
+			want:  map[string][]int{"first": {0, 2}, "remaining": {1, 3}},
+			order: []string{"first", "remaining"},
+		},
+		{
+			name:  "unknown apps",
+			waves: []Wave{{Apps: []string{"x"}}, {Percent: 50}},
+			want:  map[string][]int{"2": {0, 1}, "remaining": {2, 3}},
+			order: []string{"2", "remaining"},
+		},
+		{
+			name:  "percent rounds up",
+			waves: []Wave{{Percent: 1}, {Percent: 50}},
+			want:  map[string][]int{"1": {0}, "2": {1, 2}, "remaining": {3}},
+			order: []string{"1", "2", "remaining"},
+		},
+		{
+			name:  "percent of all",
+			waves: []Wave{{Percent: 100}, {Percent: 10}},
+			want:  map[string][]int{"1": {0, 1, 2, 3}},
+			order: []string{"1"},
+		},
+		{
+			name:  "percent over 100",
+			waves: []Wave{{Percent: 150}},
+			want:  map[string][]int{"1": {0, 1, 2, 3}},
+			order: []string{"1"},
+		},
+		{
+			name:  "no percent takes the rest",
+			waves: []Wave{{Apps: []string{"b"}}, {Percent: 0}, {Apps: []string{"d"}}},
+			want:  map[string][]int{"1": {1}, "2": {0, 2, 3}},
+			order: []string{"1", "2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string][]int{}
+			var order []string
+			for _, w := range planWaves(tt.waves, apps) {
+				got[w.name] = w.apps
+				order = append(order, w.name)
+			}
+			if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(order, tt.order) {
+				t.Errorf("planWaves() = %v in order %v, want %v in order %v", got, order, tt.want, tt.order)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import "github.com/vend/go-ecs-deploy/ecsdeploy"
+
+// Categories of failure, reported in -output json and as the exit code so that
+// CI can tell why a deploy failed
+const (
+	categoryBadInput     = ecsdeploy.CategoryBadInput
+	categoryPreflight    = "preflight_failed"
+	categoryAWS          = ecsdeploy.CategoryAWS
+	categoryTimeout      = ecsdeploy.CategoryTimeout
+	categoryLockHeld     = ecsdeploy.CategoryLockHeld
+	categoryAborted      = ecsdeploy.CategoryAborted
+	categoryRolledBack   = ecsdeploy.CategoryRolledBack
+	categoryNotification = "notification_failed"
+)
+
+// deployError is a failure along with the category it falls under
+type deployError struct {
+	category string
+	msg      string
+}
+
+func (e *deployError) Error() string {
+	return e.msg
+}
+
+// errorCategory returns the category of err, whether it's one of the CLI's or
+// the library's (see ecsdeploy.ErrorCategory)
+func errorCategory(err error) string {
+	if e, ok := err.(*deployError); ok {
+		return e.category
+	}
+	return ecsdeploy.ErrorCategory(err)
+}
+
+// exitCodes maps each category to the code the process exits with
+var exitCodes = map[string]int{
+	categoryBadInput:     2,
+	categoryPreflight:    3,
+	categoryAWS:          4,
+	categoryTimeout:      5,
+	categoryLockHeld:     6,
+	categoryAborted:      7,
+	categoryRolledBack:   8,
+	categoryNotification: 9,
+}
+
+// exitCode is 0 for success and otherwise depends on the category of err
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if code, ok := exitCodes[errorCategory(err)]; ok {
+		return code
+	}
+	return 1
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// githubTimeout bounds each GitHub API request
+const githubTimeout = 30 * time.Second
+
+var githubClient = &http.Client{Transport: &tracingTransport{}, Timeout: githubTimeout}
+
+// githubAPIURL is the API root for the repository's GitHub or GitHub
+// Enterprise host
+func githubAPIURL(repo *repository) string {
+	if *githubAPI != "" {
+		return strings.TrimSuffix(*githubAPI, "/")
+	}
+	if repo.baseURL == "https://github.com" {
+		return "https://api.github.com"
+	}
+	return repo.baseURL + "/api/v3"
+}
+
+// githubRequest calls the GitHub API for the repository, decoding the JSON
+// response into out if it's not nil. The token is read from the environment
+// variable named by -github-token-env.
+func githubRequest(repo *repository, method string, path string, body interface{}, out interface{}) error {
+	if repo.kind != repoGitHub {
+		return fmt.Errorf("%s is not a GitHub repository", repo.path)
+	}
+
+	token := os.Getenv(*githubTokenEnv)
+	if token == "" {
+		return errors.New("no GitHub token in " + *githubTokenEnv)
+	}
+
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, githubAPIURL(repo)+"/repos/"+repo.path+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := githubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("GitHub %s %s received status [%s]", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
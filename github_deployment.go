@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// GitHub deployment states set by -github-deployment
+const (
+	githubStateInProgress = "in_progress"
+	githubStateSuccess    = "success"
+	githubStateFailure    = "failure"
+	githubStateInactive   = "inactive"
+)
+
+// githubDescriptionLength is the longest description GitHub accepts
+const githubDescriptionLength = 140
+
+// githubDeployment is a deployment created with the GitHub Deployments API
+type githubDeployment struct {
+	repo     *repository
+	ID       int64 `json:"id"`
+	previous *githubDeployment
+}
+
+type githubDeploymentStatus struct {
+	State string `json:"state"`
+}
+
+// currentGitHubDeployment is the deployment created for this run, if any
+var currentGitHubDeployment *githubDeployment
+
+// startGitHubDeployment creates a GitHub deployment of the -s sha to the
+// environment and marks it in progress. Failures are only warned about, they
+// don't stop the deploy.
+func startGitHubDeployment() {
+	if *sha == "" {
+		fmt.Fprintf(progress, "Not creating a GitHub deployment without a sha (-s) \n")
+		return
+	}
+
+	repo, err := detectRepository()
+	if err != nil {
+		fmt.Fprintf(progress, "Unable to create a GitHub deployment: %v \n", err)
+		return
+	}
+
+	previous, err := lastSuccessfulGitHubDeployment(repo)
+	if err != nil {
+		fmt.Fprintf(progress, "Unable to find the previous GitHub deployment: %v \n", err)
+	}
+
+	d := &githubDeployment{repo: repo, previous: previous}
+	err = githubRequest(repo, "POST", "/deployments", map[string]interface{}{
+		"ref":         *sha,
+		"environment": *environment,
+		"description": githubDescription(fmt.Sprintf("Deploying %s to %s", requestedImage(), strings.Join(apps, ", "))),
+		"auto_merge":  false,
+		// the deploy is already underway, whatever the state of the checks
+		"required_contexts": []string{},
+		"payload": map[string]interface{}{
+			"deploy_id": deployID,
+			"apps":      apps,
+			"regions":   regions,
+			"clusters":  clusters,
+			"version":   *appVersion,
+		},
+	}, d)
+	if err != nil {
+		fmt.Fprintf(progress, "Unable to create a GitHub deployment: %v \n", err)
+		return
+	}
+
+	currentGitHubDeployment = d
+	d.setStatus(githubStateInProgress, "Deploying")
+}
+
+// finishGitHubDeployment marks this run's deployment as succeeded or failed.
+// On success the deployment it replaced is marked inactive.
+func finishGitHubDeployment(err error) {
+	d := currentGitHubDeployment
+	if d == nil {
+		return
+	}
+
+	if err != nil {
+		d.setStatus(githubStateFailure, err.Error())
+		return
+	}
+
+	d.setStatus(githubStateSuccess, "Deployed")
+	if d.previous != nil {
+		d.previous.setStatus(githubStateInactive, "Replaced by a later deploy")
+	}
+}
+
+func (d *githubDeployment) setStatus(state string, description string) {
+	err := githubRequest(d.repo, "POST", fmt.Sprintf("/deployments/%d/statuses", d.ID), map[string]interface{}{
+		"state":       state,
+		"description": githubDescription(description),
+		"environment": *environment,
+	}, nil)
+	if err != nil {
+		fmt.Fprintf(progress, "Unable to set GitHub deployment %d to %s: %v \n", d.ID, state, err)
+	}
+}
+
+// lastSuccessfulGitHubDeployment finds the most recent deployment to the
+// environment whose latest status is success, looking at the last few only.
+func lastSuccessfulGitHubDeployment(repo *repository) (*githubDeployment, error) {
+	var deployments []*githubDeployment
+	if err := githubRequest(repo, "GET", "/deployments?per_page=10&environment="+url.QueryEscape(*environment), nil, &deployments); err != nil {
+		return nil, err
+	}
+
+	for _, d := range deployments {
+		var statuses []githubDeploymentStatus
+		if err := githubRequest(repo, "GET", fmt.Sprintf("/deployments/%d/statuses?per_page=1", d.ID), nil, &statuses); err != nil {
+			return nil, err
+		}
+		if len(statuses) > 0 && statuses[0].State == githubStateSuccess {
+			d.repo = repo
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+// githubDescription shortens s to its first line, within GitHub's limit
+func githubDescription(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "\n"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if r := []rune(s); len(r) > githubDescriptionLength {
+		s = string(r[:githubDescriptionLength-3]) + "..."
+	}
+	return s
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+)
+
+// githubStatePending is the commit status while a deploy is underway
+const githubStatePending = "pending"
+
+// commitStatusRepo is the repository the pending commit status was set on,
+// and so needs its final status set.
+var commitStatusRepo *repository
+
+// commitStatusContext names the status, by default after the environment
+func commitStatusContext() string {
+	if *commitStatusName != "" {
+		return *commitStatusName
+	}
+	return "deploy/" + *environment
+}
+
+// startCommitStatus sets a pending status on the -s sha
+func startCommitStatus() {
+	if *sha == "" {
+		fmt.Fprintf(progress, "Not setting a commit status without a sha (-s) \n")
+		return
+	}
+
+	repo, err := detectRepository()
+	if err != nil {
+		fmt.Fprintf(progress, "Unable to set a commit status: %v \n", err)
+		return
+	}
+
+	if setCommitStatus(repo, githubStatePending, "Deploying to "+*environment) {
+		commitStatusRepo = repo
+	}
+}
+
+// finishCommitStatus sets the final status of the deploy on the sha
+func finishCommitStatus(err error) {
+	if commitStatusRepo == nil {
+		return
+	}
+
+	if err != nil {
+		setCommitStatus(commitStatusRepo, githubStateFailure, err.Error())
+		return
+	}
+	setCommitStatus(commitStatusRepo, githubStateSuccess, "Deployed to "+*environment)
+}
+
+// setCommitStatus reports whether the status was set
+func setCommitStatus(repo *repository, state string, description string) bool {
+	err := githubRequest(repo, "POST", "/statuses/"+*sha, map[string]interface{}{
+		"state":       state,
+		"context":     commitStatusContext(),
+		"description": githubDescription(description),
+	}, nil)
+	if err != nil {
+		fmt.Fprintf(progress, "Unable to set commit status %s to %s: %v \n", commitStatusContext(), state, err)
+		return false
+	}
+	return true
+}
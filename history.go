@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// historyRecord is what's kept about each deploy
+type historyRecord struct {
+	DeployID        string         `json:"deploy_id"`
+	StartedAt       time.Time      `json:"started_at"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Apps            []string       `json:"apps"`
+	Environment     string         `json:"environment"`
+	Version         string         `json:"version,omitempty"`
+	Deployer        string         `json:"deployer,omitempty"`
+	Result          string         `json:"result"`
+	Error           *errorResult   `json:"error,omitempty"`
+	Targets         []targetResult `json:"targets"`
+}
+
+// historyFilter selects records. Empty fields match everything.
+type historyFilter struct {
+	apps        []string
+	environment string
+	since       time.Time
+	until       time.Time
+}
+
+func (f historyFilter) matches(r *historyRecord) bool {
+	if f.environment != "" && f.environment != r.Environment {
+		return false
+	}
+	if !f.within(r.StartedAt) {
+		return false
+	}
+	if len(f.apps) == 0 {
+		return true
+	}
+	for _, app := range f.apps {
+		for _, deployed := range r.Apps {
+			if deployed == app {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// within reports whether t is in the filter's time range
+func (f historyFilter) within(t time.Time) bool {
+	return (f.since.IsZero() || !t.Before(f.since)) && (f.until.IsZero() || !t.After(f.until))
+}
+
+// historyStore keeps a record of every deploy
+type historyStore interface {
+	Append(r *historyRecord) error
+	// List returns the matching records, oldest first
+	List(f historyFilter) ([]*historyRecord, error)
+}
+
+// openHistory opens the history at location, either a local JSON lines file
+// or an s3://bucket/prefix in an S3 compatible object store. It returns nil
+// if no location is given.
+func openHistory(location string, endpoint string, sess func() *session.Session) (historyStore, error) {
+	switch {
+	case location == "":
+		return nil, nil
+	case strings.HasPrefix(location, "s3://"):
+		return newS3History(location, endpoint, sess())
+	}
+	return &fileHistory{path: location}, nil
+}
+
+// newHistoryRecord records the outcome of this run
+func newHistoryRecord(err error) *historyRecord {
+	return &historyRecord{
+		DeployID:        deployID,
+		StartedAt:       runResult.StartedAt,
+		DurationSeconds: runResult.FinishedAt.Sub(runResult.StartedAt).Seconds(),
+		Apps:            apps,
+		Environment:     *environment,
+		Version:         *appVersion,
+		Deployer:        callerARN,
+		Result:          newEvent("", err).Kind,
+		Error:           runResult.Error,
+		Targets:         runResult.Targets,
+	}
+}
+
+// fileHistory appends records to a local file, one JSON document per line
+type fileHistory struct {
+	path string
+}
+
+func (h *fileHistory) Append(r *historyRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (h *fileHistory) List(filter historyFilter) ([]*historyRecord, error) {
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*historyRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		r := &historyRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", h.path, line, err)
+		}
+		if filter.matches(r) {
+			records = append(records, r)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// runHistory implements the history command, listing past deploys from the
+// -history store or, without one, from the task definitions in ECS.
+func runHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	var appNames, clusterNames arrayFlag
+	fs.Var(&appNames, "a", "Application names (can be specified multiple times)")
+	fs.Var(&clusterNames, "c", "Cluster to show the running revisions on without -history (can be specified multiple times)")
+	env := fs.String("e", "", "Application environment, e.g. production")
+	since := fs.Duration("since", 0, "Only show deploys in the last duration, e.g. 24h")
+	until := fs.String("until", "", "Only show deploys before this time (RFC 3339)")
+	location := fs.String("history", "", "Deploy history to read: a JSON lines file or s3://bucket/prefix")
+	endpoint := fs.String("history-endpoint", "", "Endpoint of an S3 compatible store for -history")
+	region := fs.String("r", "", "AWS region of the services, or of the -history bucket")
+	limit := fs.Int("limit", 20, "Maximum number of task definition revisions to show per service without -history")
+	configPath := fs.String("config", "", "JSON config file with the history settings")
+	format := fs.String("output", outputText, "Output format: text or json")
+	networkFlags(fs)
+	credentialFlags(fs)
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := setupNetwork(config.Network); err != nil {
+		return err
+	}
+	if *location == "" {
+		*location = config.History.URL
+	}
+	if *endpoint == "" {
+		*endpoint = config.History.Endpoint
+	}
+	storeRegion := config.History.Region
+	if storeRegion == "" {
+		storeRegion = *region
+	}
+
+	filter := historyFilter{apps: appNames, environment: *env}
+	if *since > 0 {
+		filter.since = time.Now().Add(-*since)
+	}
+	if *until != "" {
+		if filter.until, err = time.Parse(time.RFC3339, *until); err != nil {
+			return fmt.Errorf("invalid -until: %v", err)
+		}
+	}
+
+	store, err := openHistory(*location, *endpoint, func() *session.Session { return newSession(storeRegion) })
+	if err != nil {
+		return err
+	}
+
+	var history interface{}
+	var print func() error
+	if store != nil {
+		records, err := store.List(filter)
+		if err != nil {
+			return err
+		}
+		if records == nil {
+			records = []*historyRecord{}
+		}
+		history, print = records, func() error { return writeRecords(os.Stdout, records) }
+	} else {
+		if !clusterNames.Specified() {
+			clusterNames = config.environment(*env).Clusters
+		}
+		if !appNames.Specified() || *env == "" || *region == "" {
+			return errors.New("without -history, -a, -e and -r are needed to read the history from ECS")
+		}
+
+		svc := ecs.New(newSession(*region))
+		revisions := map[string][]*revision{}
+		serviceNames := make([]string, len(appNames))
+		for i, app := range appNames {
+			serviceNames[i] = app + "-" + *env
+			if revisions[serviceNames[i]], err = ecsHistory(context.Background(), svc, clusterNames, serviceNames[i], filter, *limit); err != nil {
+				return err
+			}
+		}
+		history, print = revisions, func() error { return writeRevisions(os.Stdout, revisions, serviceNames) }
+	}
+
+	if *format == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(history)
+	}
+	return print()
+}
+
+// writeRecords prints one line per target of each deploy as a table
+func writeRecords(out io.Writer, records []*historyRecord) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tRESULT\tENV\tAPPS\tTARGET\tIMAGE\tPREVIOUS IMAGE\tDURATION\tDEPLOYER")
+	for _, r := range records {
+		started := r.StartedAt.Local().Format("2006-01-02 15:04:05")
+		duration := (time.Duration(r.DurationSeconds) * time.Second).String()
+		for _, t := range r.Targets {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s/%s\t%s\t%s\t%s\t%s\n",
+				started, r.Result, r.Environment, strings.Join(r.Apps, ","),
+				t.Region, t.Cluster, t.Image, t.PreviousImage, duration, r.Deployer)
+		}
+		if len(r.Targets) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\t\t\t%s\t%s\n",
+				started, r.Result, r.Environment, strings.Join(r.Apps, ","), duration, r.Deployer)
+		}
+	}
+	return w.Flush()
+}
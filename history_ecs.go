@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/vend/go-ecs-deploy/ecsdeploy"
+)
+
+// Task definitions registered by a deploy are tagged with who registered them
+// and when, since ECS itself doesn't record either.
+const (
+	deployIDTag   = "go-ecs-deploy:deploy-id"
+	deployedByTag = "go-ecs-deploy:deployed-by"
+	deployedAtTag = "go-ecs-deploy:deployed-at"
+	versionTag    = "go-ecs-deploy:version"
+	shaTag        = "go-ecs-deploy:sha"
+)
+
+// registrationTags describe this deploy on the task definition it registers,
+// as ecsdeploy.Options.TaskDefinitionTags. Where they can't be added the history
+// is just missing the deployer and time.
+func registrationTags() map[string]string {
+	tags := map[string]string{
+		deployIDTag:   deployID,
+		deployedAtTag: time.Now().UTC().Format(time.RFC3339),
+	}
+	for key, value := range map[string]string{deployedByTag: callerARN, versionTag: *appVersion, shaTag: *sha} {
+		if value != "" {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// revision is one task definition revision in a service's history
+type revision struct {
+	Family       string     `json:"family"`
+	Revision     int64      `json:"revision"`
+	ARN          string     `json:"task_definition_arn"`
+	Status       string     `json:"status"`
+	Images       []string   `json:"images"`
+	RegisteredAt *time.Time `json:"registered_at,omitempty"`
+	RegisteredBy string     `json:"registered_by,omitempty"`
+	DeployID     string     `json:"deploy_id,omitempty"`
+	Version      string     `json:"version,omitempty"`
+	SHA          string     `json:"sha,omitempty"`
+	// RunningOn lists the services currently on this revision, as cluster/service
+	RunningOn []string `json:"running_on,omitempty"`
+}
+
+// taskDefinitionFamily returns the family and revision named by a task
+// definition ARN, e.g. arn:aws:ecs:us-east-1:123456789012:task-definition/web:12
+func taskDefinitionFamily(arn string) (string, int64) {
+	name := arn[strings.LastIndex(arn, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		rev, _ := strconv.ParseInt(name[i+1:], 10, 64)
+		return name[:i], rev
+	}
+	return name, 0
+}
+
+// ecsHistory rebuilds the deploy timeline of a service from the revisions of
+// its task definition family, newest first. At most limit revisions matching
+// the filter are described.
+func ecsHistory(ctx context.Context, svc ecsdeploy.ECSAPI, clusters []string, serviceName string, filter historyFilter, limit int) ([]*revision, error) {
+	// The family is whatever the service runs now, which is usually but not
+	// necessarily named after it. Every variant of the service is checked.
+	running := map[string][]string{}
+	family := ""
+	names := []string{serviceName, ecsdeploy.CanaryServiceName(serviceName), ecsdeploy.ColourServiceName(serviceName, ecsdeploy.Blue), ecsdeploy.ColourServiceName(serviceName, ecsdeploy.Green)}
+	for _, cluster := range clusters {
+		services, err := ecsdeploy.DescribeServices(ctx, svc, cluster, names)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			s, ok := services[name]
+			if !ok {
+				continue
+			}
+			running[*s.TaskDefinition] = append(running[*s.TaskDefinition], cluster+"/"+name)
+			if family == "" || name == serviceName {
+				family, _ = taskDefinitionFamily(*s.TaskDefinition)
+			}
+		}
+	}
+	if family == "" {
+		family = serviceName
+	}
+
+	var arns []string
+	for _, status := range []string{ecs.TaskDefinitionStatusActive, ecs.TaskDefinitionStatusInactive} {
+		input := &ecs.ListTaskDefinitionsInput{
+			FamilyPrefix: aws.String(family),
+			Status:       aws.String(status),
+		}
+		for {
+			page, err := svc.ListTaskDefinitionsWithContext(ctx, input)
+			if err != nil {
+				return nil, err
+			}
+			for _, arn := range page.TaskDefinitionArns {
+				// the prefix also matches longer family names
+				if f, _ := taskDefinitionFamily(*arn); f == family {
+					arns = append(arns, *arn)
+				}
+			}
+			if page.NextToken == nil {
+				break
+			}
+			input.NextToken = page.NextToken
+		}
+	}
+	sort.Slice(arns, func(i, j int) bool {
+		_, a := taskDefinitionFamily(arns[i])
+		_, b := taskDefinitionFamily(arns[j])
+		return a > b
+	})
+
+	var revisions []*revision
+	for _, arn := range arns {
+		if limit > 0 && len(revisions) >= limit {
+			break
+		}
+
+		res, err := svc.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: aws.String(arn),
+			Include:        aws.StringSlice([]string{ecs.TaskDefinitionFieldTags}),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		r := &revision{
+			ARN:       arn,
+			Status:    aws.StringValue(res.TaskDefinition.Status),
+			RunningOn: running[arn],
+		}
+		r.Family, r.Revision = taskDefinitionFamily(arn)
+		for _, c := range res.TaskDefinition.ContainerDefinitions {
+			r.Images = append(r.Images, aws.StringValue(c.Image))
+		}
+		for _, tag := range res.Tags {
+			switch aws.StringValue(tag.Key) {
+			case deployIDTag:
+				r.DeployID = aws.StringValue(tag.Value)
+			case deployedByTag:
+				r.RegisteredBy = aws.StringValue(tag.Value)
+			case deployedAtTag:
+				if t, err := time.Parse(time.RFC3339, aws.StringValue(tag.Value)); err == nil {
+					r.RegisteredAt = &t
+				}
+			case versionTag:
+				r.Version = aws.StringValue(tag.Value)
+			case shaTag:
+				r.SHA = aws.StringValue(tag.Value)
+			}
+		}
+
+		// revisions registered before deploys were tagged have no time
+		if r.RegisteredAt == nil && (!filter.since.IsZero() || !filter.until.IsZero()) {
+			continue
+		}
+		if r.RegisteredAt != nil && !filter.within(*r.RegisteredAt) {
+			continue
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, nil
+}
+
+// writeRevisions prints the history of each service as a table
+func writeRevisions(out io.Writer, history map[string][]*revision, serviceNames []string) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tREVISION\tREGISTERED\tBY\tVERSION\tIMAGES\tRUNNING ON")
+	for _, name := range serviceNames {
+		for _, r := range history[name] {
+			registered := ""
+			if r.RegisteredAt != nil {
+				registered = r.RegisteredAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%s\t%s:%d\t%s\t%s\t%s\t%s\t%s\n",
+				name, r.Family, r.Revision, registered, r.RegisteredBy, r.Version,
+				strings.Join(r.Images, ","), strings.Join(r.RunningOn, ","))
+		}
+	}
+	return w.Flush()
+}
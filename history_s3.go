@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// s3History stores one object per deploy in an S3 compatible bucket. Objects
+// are keyed by start time so that listing them returns the oldest first and
+// older deploys can be skipped without being fetched.
+type s3History struct {
+	endpoint string
+	bucket   string
+	prefix   string
+	region   string
+	signer   *v4.Signer
+}
+
+// s3Timeout bounds each request to the history store
+const s3Timeout = 30 * time.Second
+
+var s3Client = &http.Client{Transport: &tracingTransport{}, Timeout: s3Timeout}
+
+// s3KeyTime is the layout of the time at the start of each object key
+const s3KeyTime = "2006/01/02/150405.000000000"
+
+func newS3History(location string, endpoint string, sess *session.Session) (*s3History, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid history location %s", location)
+	}
+
+	region := aws.StringValue(sess.Config.Region)
+	if region == "" {
+		region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &s3History{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		bucket:   u.Host,
+		prefix:   prefix,
+		region:   region,
+		signer:   v4.NewSigner(sess.Config.Credentials),
+	}, nil
+}
+
+func (h *s3History) Append(r *historyRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	key := h.prefix + r.StartedAt.UTC().Format(s3KeyTime) + "-" + r.DeployID + ".json"
+	resp, err := h.do("PUT", "/"+key, nil, b)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (h *s3History) List(filter historyFilter) ([]*historyRecord, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {h.prefix}}
+	if !filter.since.IsZero() {
+		query.Set("start-after", h.prefix+filter.since.UTC().Format(s3KeyTime))
+	}
+
+	var keys []string
+	for {
+		resp, err := h.do("GET", "/", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var list s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range list.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !list.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+	sort.Strings(keys)
+
+	var records []*historyRecord
+	for _, key := range keys {
+		resp, err := h.do("GET", "/"+key, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		r := &historyRecord{}
+		err = json.NewDecoder(resp.Body).Decode(r)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		if filter.matches(r) {
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+// do sends a signed path style request for the bucket
+func (h *s3History) do(method string, path string, query url.Values, body []byte) (*http.Response, error) {
+	u := h.endpoint + "/" + h.bucket + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	var seeker io.ReadSeeker = bytes.NewReader(body)
+	if _, err := h.signer.Sign(req, seeker, "s3", h.region, time.Now()); err != nil {
+		return nil, err
+	}
+
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s received status [%s] %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
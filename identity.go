@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// callerARN is the identity the deploy runs as, once it has been checked
+var callerARN string
+
+// checkCallerIdentity asks STS who we are and fails unless it matches the
+// account and role expected for the environment being deployed to. Either may
+// be empty to accept any.
+func checkCallerIdentity(sess *session.Session, accountID string, role string) error {
+	identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return &deployError{categoryAWS, fmt.Sprintf("Failed: unable to determine AWS identity \n`%s`", err.Error())}
+	}
+	return checkIdentity(*identity.Account, *identity.Arn, accountID, role)
+}
+
+// checkIdentity fails unless the account and ARN being deployed as are the
+// ones expected, and otherwise notes the ARN as the caller
+func checkIdentity(account string, arn string, accountID string, role string) error {
+	if accountID != "" && accountID != account {
+		return &deployError{categoryBadInput, fmt.Sprintf("Failed: deploying %s to %s from account %s as %s, expected account %s\n", apps, *environment, account, arn, accountID)}
+	}
+
+	if role != "" && roleName(role) != roleName(arn) {
+		return &deployError{categoryBadInput, fmt.Sprintf("Failed: deploying %s to %s as %s, expected role %s\n", apps, *environment, arn, role)}
+	}
+
+	callerARN = arn
+	return nil
+}
+
+// roleName extracts the role name from an IAM role ARN, an STS assumed-role
+// ARN, or returns the value unchanged if it's already a plain name.
+//
+//	arn:aws:iam::123456789012:role/path/deploy         -> deploy
+//	arn:aws:sts::123456789012:assumed-role/deploy/ci   -> deploy
+func roleName(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 {
+		return arn
+	}
+	resource := strings.Split(parts[5], "/")
+	switch resource[0] {
+	case "role":
+		return resource[len(resource)-1]
+	case "assumed-role":
+		if len(resource) > 1 {
+			return resource[1]
+		}
+	}
+	return parts[5]
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestRoleName(t *testing.T) {
+	tests := []struct {
+		arn  string
+		want string
+	}{
+		{"deploy", "deploy"},
+		{"arn:aws:iam::123456789012:role/deploy", "deploy"},
+		{"arn:aws:iam::123456789012:role/path/to/deploy", "deploy"},
+		{"arn:aws:sts::123456789012:assumed-role/deploy/ci-session", "deploy"},
+		{"arn:aws:sts::123456789012:assumed-role/deploy", "deploy"},
+		{"arn:aws:iam::123456789012:user/someone", "user/someone"},
+		{"arn:aws:sts::123456789012:assumed-role", "assumed-role"},
+	}
+
+	for _, tt := range tests {
+		if got := roleName(tt.arn); got != tt.want {
+			t.Errorf("roleName(%q) = %q, want %q", tt.arn, got, tt.want)
+		}
+	}
+}
@@ -1,18 +1,21 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/vend/go-ecs-deploy/ecsdeploy"
 )
 
 type arrayFlag []string
@@ -31,252 +34,468 @@ func (flags *arrayFlag) Specified() bool {
 }
 
 var (
-	clusterName    = flag.String("c", "", "Cluster name to deploy to")
 	repoName       = flag.String("i", "", "Container repo to pull from e.g. quay.io/username/reponame")
 	environment    = flag.String("e", "", "Application environment, e.g. production")
 	sha            = flag.String("s", "", "Tag, usually short git SHA to deploy")
-	region         = flag.String("r", "", "AWS region")
 	webhook        = flag.String("w", "", "Webhook (slack) URL to post to")
 	targetImage    = flag.String("t", "", "Target image (overrides -s and -i)")
 	preflightURL   = flag.String("p", "", "Preflight URL, if this url returns anything but 200 deploy is aborted")
 	debug          = flag.Bool("d", false, "enable Debug output")
+	output         = flag.String("output", outputText, "Output format: text or json (a result document on stdout)")
 	multiContainer = flag.Bool("m", false, "Multicontainer service")
 	appVersion     = flag.String("v", "", "Application version, e.g. '1234' or '12.3.4'")
+
+	slackFormat       = flag.String("slack-format", slackFormatRich, "Slack message format: rich (colour coded attachments) or plain")
+	notifyStart       = flag.Bool("notify-start", false, "Also notify when the deploy starts")
+	webhookTimeout    = flag.Duration("webhook-timeout", 10*time.Second, "Timeout for each notification request")
+	webhookRetries    = flag.Int("webhook-retries", 3, "Number of times to retry a notification that is rate limited or fails")
+	failOnNotifyError = flag.Bool("fail-on-notify-error", false, "Fail the run if a notification can't be delivered")
+	teamsWebhook      = flag.String("teams-webhook", "", "Microsoft Teams incoming webhook URL to post to")
+	discordWebhook    = flag.String("discord-webhook", "", "Discord webhook URL to post to")
+
+	repoURL  = flag.String("repo-url", "", "Source repository URL for diff links (detected from CI or git by default)")
+	repoType = flag.String("repo-type", "", "Source repository host type for diff links: github, gitlab or bitbucket")
+
+	changelogSize   = flag.Int("changelog", 0, "Include up to this many commits since the deployed sha in notifications")
+	changelogSource = flag.String("changelog-source", changelogAuto, "Where to read the changelog: git (the local checkout), github (the compare API) or auto")
+	githubAPI       = flag.String("github-api", "", "GitHub API URL (defaults to api.github.com, or <host>/api/v3 for GitHub Enterprise)")
+	githubTokenEnv  = flag.String("github-token-env", "GITHUB_TOKEN", "Environment variable holding the GitHub API token")
+
+	githubDeployments = flag.Bool("github-deployment", false, "Create a GitHub deployment for the sha and environment and report the deploy's progress on it")
+	commitStatus      = flag.Bool("commit-status", false, "Set a pending, success or failure commit status for the deploy on the sha")
+	commitStatusName  = flag.String("commit-status-context", "", "Context of the commit status (default deploy/<environment>)")
+
+	parallelism = flag.Int("parallelism", 1, "Number of services to update at once")
+	wait        = flag.Bool("wait", false, "Wait for each service to become stable after updating it")
+	waitTimeout = flag.Duration("wait-timeout", 10*time.Minute, "How long to wait for a service to become stable")
+
+	canary     = flag.Bool("canary", false, "Deploy to each app's <app>-<env>-canary service first and only continue if it stays healthy")
+	canaryBake = flag.Duration("canary-bake", 5*time.Minute, "How long the canary must run without stopped tasks")
+
+	blueGreen = flag.Bool("blue-green", false, "Deploy to the idle one of each app's <app>-<env>-blue and -green services and swap it live")
+
+	useLock     = flag.Bool("lock", false, "Take an advisory lock on each service (stored as tags) for the duration of the deploy")
+	waitForLock = flag.Duration("wait-for-lock", 0, "How long to wait for another deploy's lock to be released")
+	breakLock   = flag.Bool("break-lock", false, "Take the lock even if another deploy holds it")
+	lockTTL     = flag.Duration("lock-ttl", 30*time.Minute, "How long a lock is held before others may consider it abandoned")
+
+	regionParallelism = flag.Int("region-parallelism", 1, "Number of regions and clusters to deploy to at once")
+	onRegionFailure   = flag.String("on-region-failure", ecsdeploy.OnFailureContinue, "What to do when a region or cluster fails: continue, stop (skip remaining ones) or rollback (also revert deployed ones)")
+
+	configFile        = flag.String("config", "", "JSON config file with per-environment settings")
+	expectedAccountID = flag.String("expected-account-id", "", "Abort unless running as this AWS account")
+	expectedRole      = flag.String("expected-role", "", "Abort unless running as this IAM role (name or ARN)")
+
+	webIdentityRoleARN     = flag.String("role-arn", "", "Role to assume with a web identity token (defaults to $AWS_ROLE_ARN)")
+	webIdentityTokenFile   = flag.String("web-identity-token-file", "", "File containing an OIDC token for -role-arn (defaults to $AWS_WEB_IDENTITY_TOKEN_FILE)")
+	webIdentityTokenEnv    = flag.String("web-identity-token-env", "", "Environment variable containing an OIDC token for -role-arn")
+	webIdentitySessionName = flag.String("role-session-name", "go-ecs-deploy", "Session name used when assuming -role-arn")
+
+	statsdAddr   = flag.String("statsd", "", "StatsD or DogStatsD address (host:port) to send deploy metrics to over UDP")
+	statsdPrefix = flag.String("statsd-prefix", "go_ecs_deploy.", "Prefix of every metric name")
+	statsdFormat = flag.String("statsd-format", statsdFormatDogStatsD, "Metric format: dogstatsd (with tags) or statsd")
+
+	otlpEndpoint = flag.String("otlp-endpoint", "", "Collector to export a trace of the deploy to, e.g. http://localhost:4318. Only OTLP over HTTP is supported, not gRPC (defaults to $OTEL_EXPORTER_OTLP_ENDPOINT)")
+
+	ecsEndpoint = flag.String("ecs-endpoint", "", "ECS endpoint URL to use instead of AWS, e.g. http://localhost:4566 for LocalStack")
+	stsEndpoint = flag.String("sts-endpoint", "", "STS endpoint URL to use instead of AWS")
+	httpsProxy  = flag.String("https-proxy", "", "Proxy URL for HTTPS requests to AWS, webhooks and the preflight URL (defaults to $HTTPS_PROXY)")
+	caBundle    = flag.String("ca-bundle", "", "PEM file of CA certificates to trust as well as the system ones")
+	maxRetries  = flag.Int("max-retries", -1, "Number of times the AWS SDK retries a failed request (default the SDK's own)")
+
+	simulate = flag.String("simulate", "", "Rehearse the deploy against an in-memory ECS seeded from this JSON fixture, without calling AWS")
+
+	historyLocation = flag.String("history", "", "Record every deploy in a JSON lines file or s3://bucket/prefix")
+	historyEndpoint = flag.String("history-endpoint", "", "Endpoint of an S3 compatible store for -history")
 )
 
+// deployID identifies this run, e.g. as the owner of service locks
+var deployID = newDeployID()
+
 var channels arrayFlag
+var eventWebhooks arrayFlag
 var apps arrayFlag
+var regions arrayFlag
+var clusters arrayFlag
 
-func fail(s string) {
-	fmt.Printf(s)
-	sendWebhooks(s)
-	os.Exit(2)
-}
-
-type SlackMessage struct {
-	Text     string  `json:"text"`
-	Username string  `json:"username"`
-	Channel  *string `json:"channel,omitempty"`
-}
+// preflightClient checks the -p URL
+var preflightClient = &http.Client{Transport: &tracingTransport{}}
 
-func sendWebhook(message string, url *string, channel *string) {
-	json, _ := json.Marshal(SlackMessage{
-		Text:     message,
-		Username: "GO ECS Deploy",
-		Channel:  channel,
-	})
-	reader := bytes.NewReader(json)
-	http.Post(*url, "application/json", reader)
-}
+// loadedConfig is the -config file, once run has read it
+var loadedConfig *Config
 
-func sendWebhooks(message string) {
-	if len(channels) > 0 {
-		for _, channel := range channels {
-			sendWebhook(message, webhook, &channel)
-		}
-	} else {
-		sendWebhook(message, webhook, nil)
+func newDeployID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
 	}
+	return hex.EncodeToString(b)
 }
 
 func init() {
 	flag.Var(&channels, "C", "Slack channels to post to (can be specified multiple times)")
+	flag.Var(&eventWebhooks, "event-webhook", "URL to post the full deploy event to as JSON (can be specified multiple times)")
 	flag.Var(&apps, "a", "Application names (can be specified multiple times)")
+	flag.Var(&clusters, "c", "Cluster name to deploy to (can be specified multiple times)")
+	flag.Var(&regions, "r", "AWS region (can be specified multiple times)")
 
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		if err := runHistory(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flag.Parse()
 
-	// First check is to the preflight URL
-	if *preflightURL != "" {
-		resp, err := http.Get(*preflightURL)
-		if err != nil {
-			fail(fmt.Sprintf("failed to check %s, received error %v", *preflightURL, err))
-		}
-		if resp.StatusCode != 200 {
-			fail(fmt.Sprintf("failed to check %s, received status [%s] with headers %v", *preflightURL, resp.Status, resp.Header))
-		}
+	if endpoint, err := traceEndpoint(); err != nil {
+		fmt.Fprintf(progress, "Not exporting a trace: %v\n", err)
+	} else if endpoint != "" {
+		traces = newTracer(endpoint)
+	}
+	ctx, root := startSpan(context.Background(), "deploy",
+		"deploy.id", deployID,
+		"deployment.environment", *environment,
+		"apps", strings.Join(apps, ","))
+
+	msg, err := run(ctx)
+	if err != nil {
+		msg = err.Error()
+		fmt.Fprint(progress, msg)
 	}
 
-	if *clusterName == "" || !apps.Specified() || *environment == "" || *region == "" {
+	// notify once, whatever happened, then report the outcome including any
+	// -fail-on-notify-error failure everywhere else
+	finishResult(err)
+	if notifyErr := notify(ctx, newEvent(msg, err)); notifyErr != nil && *failOnNotifyError && err == nil {
+		err = &deployError{categoryNotification, notifyErr.Error()}
+		finishResult(err)
+	}
+	finishGitHubDeployment(err)
+	finishCommitStatus(err)
+	recordMetrics(err)
+	if err := recordHistory(err); err != nil {
+		fmt.Fprintf(progress, "Unable to record deploy history: %v \n", err)
+	}
+	root.finish(err)
+	if err := exportTraces(); err != nil {
+		fmt.Fprintf(progress, "Unable to export the trace: %v \n", err)
+	}
+	writeResult()
+	os.Exit(exitCode(err))
+}
+
+// run validates the flags and deploys to every target, returning the summary
+// to notify with or an error saying why the deploy failed.
+func run(ctx context.Context) (string, error) {
+	if *output == outputJSON {
+		progress = os.Stderr
+	} else if *output != outputText {
 		flag.Usage()
-		fail(fmt.Sprintf("Failed deployment of apps %s : missing parameters\n", apps))
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : unknown -output %s\n", apps, *output)}
 	}
 
-	if (*repoName == "" || *sha == "") && *targetImage == "" {
+	// until the config is loaded only the notifiers given as flags are known
+	configuredNotifiers, _ = notifiers(&Config{}, EnvironmentConfig{})
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : %v\n", apps, err)}
+	}
+	loadedConfig = config
+
+	if err := setupNetwork(config.Network); err != nil {
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : %v\n", apps, err)}
+	}
+
+	envConfig := config.environment(*environment)
+
+	switch *repoType {
+	case "", repoGitHub, repoGitLab, repoBitbucket:
+	default:
 		flag.Usage()
-		fail(fmt.Sprintf("Failed deployment %s : no repo name, sha or target image specified\n", apps))
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : unknown -repo-type %s\n", apps, *repoType)}
 	}
 
-	// Take the first app specified and use it for creating the task definitions for all services.
-	exemplarServiceName := apps[0] + "-" + *environment
-	cfg := &aws.Config{
-		Region: aws.String(*region),
+	switch *changelogSource {
+	case changelogAuto, changelogGit, changelogGitHub:
+	default:
+		flag.Usage()
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : unknown -changelog-source %s\n", apps, *changelogSource)}
 	}
-	if *debug {
-		cfg = cfg.WithLogLevel(aws.LogDebug)
+
+	if *slackFormat != slackFormatRich && *slackFormat != slackFormatPlain {
+		flag.Usage()
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : unknown -slack-format %s\n", apps, *slackFormat)}
 	}
 
-	svc := ecs.New(session.New(), cfg)
+	if *statsdFormat != statsdFormatDogStatsD && *statsdFormat != statsdFormatStatsD {
+		flag.Usage()
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : unknown -statsd-format %s\n", apps, *statsdFormat)}
+	}
 
-	if *targetImage == "" {
-		fmt.Printf("Request to deploy sha: %s to %s at %s \n", *sha, *environment, *region)
-	} else {
-		fmt.Printf("Request to deploy target image: %s to %s at %s \n", *targetImage, *environment, *region)
+	if *statsdAddr != "" {
+		if metrics, err = newStatsdClient(*statsdAddr, *statsdPrefix, *statsdFormat); err != nil {
+			fmt.Fprintf(progress, "Unable to send metrics to %s: %v \n", *statsdAddr, err)
+		}
 	}
-	fmt.Printf("Describing services for cluster %s and service %s \n", *clusterName, exemplarServiceName)
 
-	serviceDesc, err :=
-		svc.DescribeServices(
-			&ecs.DescribeServicesInput{
-				Cluster:  clusterName,
-				Services: []*string{&exemplarServiceName},
-			})
+	ns, err := notifiers(config, envConfig)
 	if err != nil {
-		fail(fmt.Sprintf("Failed to describe %s \n`%s`", exemplarServiceName, err.Error()))
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : %v\n", apps, err)}
+	}
+	configuredNotifiers = ns
+
+	// First check is to the preflight URL
+	if *preflightURL != "" {
+		started := time.Now()
+		preflightCtx, s := startSpan(ctx, "preflight")
+		err := preflight(preflightCtx)
+		s.finish(err)
+		metrics.timing("preflight", time.Since(started), metricTags(apps, resultTag(err))...)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !clusters.Specified() {
+		clusters = envConfig.Clusters
 	}
 
-	if len(serviceDesc.Services) < 1 {
-		msg := fmt.Sprintf("No service %s found on cluster %s", exemplarServiceName, *clusterName)
-		fail("Failed: " + msg)
+	if !clusters.Specified() || !apps.Specified() || *environment == "" || !regions.Specified() {
+		flag.Usage()
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : missing parameters\n", apps)}
 	}
 
-	service := serviceDesc.Services[0]
-	if exemplarServiceName != *service.ServiceName {
-		msg := fmt.Sprintf("Found the wrong service when looking for %s found %s \n", exemplarServiceName, *service.ServiceName)
-		fail("Failed: " + msg)
+	if (*repoName == "" || *sha == "") && *targetImage == "" {
+		flag.Usage()
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment %s : no repo name, sha or target image specified\n", apps)}
 	}
 
-	fmt.Printf("Found existing ARN %s for service %s \n", *service.ClusterArn, *service.ServiceName)
+	if *canary && *blueGreen {
+		flag.Usage()
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment %s : -canary and -blue-green can't be combined\n", apps)}
+	}
+
+	if *parallelism < 1 {
+		*parallelism = 1
+	}
+
+	switch *onRegionFailure {
+	case ecsdeploy.OnFailureContinue, ecsdeploy.OnFailureStop, ecsdeploy.OnFailureRollback:
+	default:
+		flag.Usage()
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment %s : unknown -on-region-failure %s\n", apps, *onRegionFailure)}
+	}
 
-	taskDesc, err :=
-		svc.DescribeTaskDefinition(
-			&ecs.DescribeTaskDefinitionInput{
-				TaskDefinition: service.TaskDefinition})
+	waves, err := deployWaves(envConfig.Waves)
 	if err != nil {
-		fail(fmt.Sprintf("Failed: deployment %s \n`%s`", exemplarServiceName, err.Error()))
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : %v\n", apps, err)}
 	}
 
-	if *debug {
-		fmt.Printf("Current task description: \n%+v \n", taskDesc)
-	}
-
-	var containerDef *ecs.ContainerDefinition
-	var oldImage *string
-	// multiContainer service
-	if *multiContainer {
-		fmt.Printf("Task definition has multiple containers \n")
-		var i int
-		for i, containerDef = range taskDesc.TaskDefinition.ContainerDefinitions {
-			oldImage = containerDef.Image
-			x := *targetImage
-			if *targetImage == "" {
-				// Split repoName and Tag
-				imageString := *oldImage
-				pair := strings.Split(imageString, ":")
-				if len(pair) == 2 {
-					fmt.Printf("Updating sha on repo: %s \n", pair[0])
-					x = fmt.Sprintf("%s:%s", pair[0], *sha)
-				} else {
-					x = fmt.Sprintf("%s:%s", *repoName, *sha)
-				}
-			}
-			containerDef.Image = &x
-			taskDesc.TaskDefinition.ContainerDefinitions[i] = containerDef
+	// Make sure we're deploying to the account we think we are before touching anything
+	if *expectedAccountID != "" {
+		envConfig.AccountID = *expectedAccountID
+	}
+	if *expectedRole != "" {
+		envConfig.Role = *expectedRole
+	}
+
+	var client func(region string) ecsdeploy.ECSAPI
+	if *simulate != "" {
+		fixture, err := ecsdeploy.LoadFixture(*simulate)
+		if err != nil {
+			return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : %v\n", apps, err)}
+		}
+		if client, err = simulatedECS(fixture); err != nil {
+			return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : %v\n", apps, err)}
 		}
+		account, arn := simulatedIdentity(fixture)
+		if err := checkIdentity(account, arn, envConfig.AccountID, envConfig.Role); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(progress, "Simulating ECS from %s \n", *simulate)
 	} else {
-		containerDef = taskDesc.TaskDefinition.ContainerDefinitions[0]
-		oldImage = containerDef.Image
-		x := *targetImage
-		if *targetImage == "" {
-			x = fmt.Sprintf("%s:%s", *repoName, *sha)
+		sess := newSession(regions[0])
+		if err := checkCallerIdentity(sess, envConfig.AccountID, envConfig.Role); err != nil {
+			return "", err
+		}
+		client = func(region string) ecsdeploy.ECSAPI {
+			return ecs.New(sess, aws.NewConfig().WithRegion(region))
 		}
-		containerDef.Image = &x
 	}
+	fmt.Fprintf(progress, "Deploying as %s \n", callerARN)
 
-	futureDef := &ecs.RegisterTaskDefinitionInput{
-		ContainerDefinitions:    taskDesc.TaskDefinition.ContainerDefinitions,
-		Family:                  taskDesc.TaskDefinition.Family,
-		Volumes:                 taskDesc.TaskDefinition.Volumes,
-		NetworkMode:             taskDesc.TaskDefinition.NetworkMode,
-		TaskRoleArn:             taskDesc.TaskDefinition.TaskRoleArn,
-		Cpu:                     taskDesc.TaskDefinition.Cpu,
-		Memory:                  taskDesc.TaskDefinition.Memory,
-		RequiresCompatibilities: taskDesc.TaskDefinition.RequiresCompatibilities,
-		ExecutionRoleArn:        taskDesc.TaskDefinition.ExecutionRoleArn,
-		PlacementConstraints:    taskDesc.TaskDefinition.PlacementConstraints,
+	if *notifyStart {
+		notify(ctx, &event{Kind: eventStart, Message: fmt.Sprintf("Deploying %s for *%s* to *%s*", requestedImage(), apps, clusters), Result: runResult})
 	}
 
-	if *debug {
-		fmt.Printf("Future task description: \n%+v \n", futureDef)
+	if *githubDeployments {
+		startGitHubDeployment()
+	}
+	if *commitStatus {
+		startCommitStatus()
 	}
 
-	registerRes, err :=
-		svc.RegisterTaskDefinition(futureDef)
+	ts := ecsdeploy.Targets(regions, clusters)
+	dep := ecsdeploy.New(client, ecsdeploy.Options{
+		Apps:               apps,
+		Environment:        *environment,
+		Image:              *targetImage,
+		Repo:               *repoName,
+		SHA:                *sha,
+		MultiContainer:     *multiContainer,
+		Parallelism:        *parallelism,
+		Wait:               *wait,
+		WaitTimeout:        *waitTimeout,
+		Canary:             *canary,
+		CanaryBake:         *canaryBake,
+		BlueGreen:          *blueGreen,
+		Lock:               *useLock,
+		WaitForLock:        *waitForLock,
+		BreakLock:          *breakLock,
+		LockTTL:            *lockTTL,
+		Waves:              waves,
+		TargetParallelism:  *regionParallelism,
+		OnFailure:          *onRegionFailure,
+		DeployID:           deployID,
+		Owner:              callerARN,
+		TaskDefinitionTags: registrationTags(),
+		Debug:              *debug,
+	})
+	dep.OnEvent = printEvent(ts)
+	dep.Phase = observePhase
+	dep.Approve = approveOnStdin(ts)
+
+	results, err := dep.Deploy(ctx, ts)
 	if err != nil {
-		fail(fmt.Sprintf("Failed: deployment %s for %s to %s \n`%s`", *containerDef.Image, exemplarServiceName, *clusterName, err.Error()))
+		return "", &deployError{categoryBadInput, fmt.Sprintf("Failed deployment of apps %s : %v\n", apps, err)}
 	}
 
-	newArn := registerRes.TaskDefinition.TaskDefinitionArn
+	outcomes := describeChanges(results, ts)
+	recordOutcomes(outcomes)
 
-	fmt.Printf("Registered new task for %s:%s \n", *sha, *newArn)
-
-	// Get first container definition to create slack message
-	containerDef = taskDesc.TaskDefinition.ContainerDefinitions[0]
+	msg, ok := summary(outcomes, ts)
+	if !ok {
+		return "", &deployError{failureCategory(outcomes), msg}
+	}
+	return msg, nil
+}
 
-	var appDisplayVersion string
-	if *appVersion != "" {
-		appDisplayVersion = fmt.Sprintf(" (version %s)", *appVersion)
+// observePhase traces each phase of the deploy and times those there are
+// metrics for
+func observePhase(ctx context.Context, p ecsdeploy.Phase) (context.Context, func(error)) {
+	name := p.Name
+	attrs := []string{"cloud.region", p.Target.Region, "cluster", p.Target.Cluster}
+	if p.Service != "" {
+		name += " " + p.Service
+		attrs = append(attrs, "app", p.App, "service", p.Service)
 	}
 
-	// update services to use new definition
-	for _, appName := range apps {
-		serviceName := appName + "-" + *environment
+	ctx, s := startSpan(ctx, name, attrs...)
+	started := time.Now()
 
-		_, err = svc.UpdateService(
-			&ecs.UpdateServiceInput{
-				Cluster:        clusterName,
-				Service:        &serviceName,
-				DesiredCount:   service.DesiredCount,
-				TaskDefinition: newArn,
-			})
-		if err != nil {
-			fail(fmt.Sprintf("Failed: deployment %s for %s to %s as %s \n`%s`", *containerDef.Image, appName, *clusterName, *newArn, err.Error()))
+	return ctx, func(err error) {
+		s.finish(err)
+		switch {
+		case p.Name == ecsdeploy.PhaseRegister:
+			metrics.timing(p.Name, time.Since(started), targetTags(p.Target, apps, resultTag(err))...)
+		case (p.Name == ecsdeploy.PhaseUpdate || p.Name == ecsdeploy.PhaseStabilise) && p.App != "":
+			metrics.timing(p.Name, time.Since(started), targetTags(p.Target, []string{p.App}, resultTag(err))...)
 		}
+	}
+}
 
-		slackMsg := fmt.Sprintf("Deployed %s for *%s%s* to *%s* as `%s`", *containerDef.Image, appName, appDisplayVersion, *clusterName, *newArn)
-
-		// extract old image sha, and use it to generate a git compare URL
-		if *oldImage != "" && *sha != "" {
-			parts := strings.Split(*oldImage, ":")
-			if len(parts) == 2 {
-				// possibly a tagged image "def15c31-php5.5"
-				parts = strings.Split(parts[1], "-")
-				if gitURL, err := gitURL(parts[0], *sha); err == nil {
-					slackMsg += " (<" + gitURL + "|diff>)"
-				}
-			}
-		}
-		sendWebhooks(slackMsg)
+// preflight checks the -p URL returns 200
+func preflight(ctx context.Context) error {
+	req, err := http.NewRequest("GET", *preflightURL, nil)
+	if err != nil {
+		return &deployError{categoryBadInput, fmt.Sprintf("invalid preflight URL %s: %v", *preflightURL, err)}
+	}
 
-		fmt.Printf("Updated %s service to use new ARN: %s \n", serviceName, *newArn)
+	resp, err := preflightClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return &deployError{categoryPreflight, fmt.Sprintf("failed to check %s, received error %v", *preflightURL, err)}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return &deployError{categoryPreflight, fmt.Sprintf("failed to check %s, received status [%s] with headers %v", *preflightURL, resp.Status, resp.Header)}
+	}
+	return nil
+}
+
+// traceEndpoint is where traces go: -otlp-endpoint or the standard
+// OpenTelemetry variables. Only OTLP over HTTP is supported, so a gRPC protocol
+// set for the variables is an error.
+func traceEndpoint() (string, error) {
+	if *otlpEndpoint != "" {
+		return *otlpEndpoint, nil
 	}
 
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if endpoint != "" && protocol == "grpc" {
+		return "", fmt.Errorf("OTLP over gRPC isn't supported, set -otlp-endpoint to the collector's OTLP/HTTP endpoint (usually port 4318)")
+	}
+	return endpoint, nil
 }
 
-// gitURL uses git since the program runs in many CI environments
-func gitURL(startSHA string, endSHA string) (string, error) {
-	var project string
+// newSession returns an AWS session for region, using web identity
+// credentials if a role was given.
+func newSession(region string) *session.Session {
+	cfg := network.awsConfig(&aws.Config{
+		Region: aws.String(region),
+	})
+	if *debug {
+		cfg = cfg.WithLogLevel(aws.LogDebug)
+	}
 
-	if travisSlug, ok := os.LookupEnv("TRAVIS_REPO_SLUG"); ok {
-		project = travisSlug
+	sess := session.New(cfg)
+	instrumentSession(sess)
+	if creds := webIdentityCredentials(sess); creds != nil {
+		sess.Config.Credentials = creds
 	}
+	return sess
+}
 
-	if project == "" {
-		return "", errors.New("nope")
+// recordHistory appends this run to the deploy history, if one is configured
+func recordHistory(err error) error {
+	location, endpoint, region := *historyLocation, *historyEndpoint, ""
+	if loadedConfig != nil {
+		if location == "" {
+			location = loadedConfig.History.URL
+		}
+		if endpoint == "" {
+			endpoint = loadedConfig.History.Endpoint
+		}
+		region = loadedConfig.History.Region
 	}
+	if region == "" && regions.Specified() {
+		region = regions[0]
+	}
+
+	store, openErr := openHistory(location, endpoint, func() *session.Session { return newSession(region) })
+	if openErr != nil || store == nil {
+		return openErr
+	}
+	return store.Append(newHistoryRecord(err))
+}
 
-	url := "https://github.com/" + project + "/compare/" + startSHA + "..." + endSHA
-	return url, nil
+// gitURL links to the changes between the deployed and the new sha
+func gitURL(startSHA string, endSHA string) (string, error) {
+	repo, err := detectRepository()
+	if err != nil {
+		return "", err
+	}
+	return repo.compareURL(startSHA, endSHA), nil
 }
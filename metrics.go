@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vend/go-ecs-deploy/ecsdeploy"
+)
+
+// StatsD line formats for -statsd-format. Plain StatsD has no tags.
+const (
+	statsdFormatDogStatsD = "dogstatsd"
+	statsdFormatStatsD    = "statsd"
+)
+
+// statsdClient sends metrics over UDP. Sends are fire and forget, a missing
+// metric never fails a deploy. A nil client sends nothing.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+}
+
+// metrics is where deploy metrics go, set with -statsd
+var metrics *statsdClient
+
+func newStatsdClient(addr string, prefix string, format string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdClient{conn: conn, prefix: prefix, tags: format == statsdFormatDogStatsD}, nil
+}
+
+func (s *statsdClient) send(name string, value string, kind string, tags []string) {
+	if s == nil {
+		return
+	}
+	line := s.prefix + name + ":" + value + "|" + kind
+	if s.tags && len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	s.conn.Write([]byte(line))
+}
+
+// timing records how long a phase took, in milliseconds
+func (s *statsdClient) timing(name string, d time.Duration, tags ...string) {
+	s.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms", tags)
+}
+
+func (s *statsdClient) increment(name string, tags ...string) {
+	s.send(name, "1", "c", tags)
+}
+
+// metricTags tags metrics with the environment, each app and then extra
+func metricTags(appNames []string, extra ...string) []string {
+	tags := []string{"env:" + *environment}
+	for _, app := range appNames {
+		tags = append(tags, "app:"+app)
+	}
+	return append(tags, extra...)
+}
+
+// targetTags tag metrics about a single target
+func targetTags(t ecsdeploy.Target, appNames []string, extra ...string) []string {
+	return metricTags(appNames, append([]string{"cluster:" + t.Cluster, "region:" + t.Region}, extra...)...)
+}
+
+// resultTag is success or failure depending on err
+func resultTag(err error) string {
+	if err != nil {
+		return "result:failure"
+	}
+	return "result:success"
+}
+
+// recordMetrics counts the outcome of the deploy, of each target and of each
+// service, and times the whole run.
+func recordMetrics(err error) {
+	if metrics == nil {
+		return
+	}
+
+	result := "result:" + newEvent("", err).Kind
+	metrics.increment("deploy", metricTags(apps, result)...)
+	metrics.timing("deploy.duration", runResult.FinishedAt.Sub(runResult.StartedAt), metricTags(apps, result)...)
+
+	for _, t := range runResult.Targets {
+		location := []string{"cluster:" + t.Cluster, "region:" + t.Region}
+		metrics.increment("target", metricTags(apps, append(location, "result:"+t.Status)...)...)
+		for _, s := range t.Services {
+			metrics.increment("service", metricTags([]string{s.App}, append(location, "result:"+s.Status)...)...)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vend/go-ecs-deploy/ecsdeploy"
+)
+
+func TestRecordMetrics(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := newStatsdClient(conn.LocalAddr().String(), "deploy.", statsdFormatDogStatsD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(m *statsdClient, r *result, a arrayFlag, env string) {
+		metrics, runResult, apps, *environment = m, r, a, env
+	}(metrics, runResult, apps, *environment)
+	metrics, apps, *environment = client, arrayFlag{"web"}, "production"
+
+	// the canary's service name isn't the app with the environment appended,
+	// its app tag must still be the app
+	runResult = &result{Targets: []targetResult{{
+		Region:  "us-east-1",
+		Cluster: "vend-production",
+		Status:  ecsdeploy.StatusDeployed,
+		Services: []ecsdeploy.ServiceResult{
+			{App: "web", Name: "web-production", Status: ecsdeploy.StatusDeployed},
+			{App: "web", Name: "web-production-canary", Status: ecsdeploy.StatusDeployed},
+		},
+	}}}
+	recordMetrics(nil)
+
+	var services []string
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 5; i++ {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line := string(buf[:n]); strings.HasPrefix(line, "deploy.service:") {
+			services = append(services, line)
+		}
+	}
+
+	want := "deploy.service:1|c|#env:production,app:web,cluster:vend-production,region:us-east-1,result:deployed"
+	if len(services) != 2 || services[0] != want || services[1] != want {
+		t.Errorf("service metrics = %q, want two of %q", services, want)
+	}
+}
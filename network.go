@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// networkFlagNames are the flags setupNetwork reads, shared with the history
+// command
+var networkFlagNames = []string{"ecs-endpoint", "sts-endpoint", "https-proxy", "ca-bundle", "max-retries"}
+
+// network is how AWS and everything else is reached, once setupNetwork has run
+var network NetworkConfig
+
+// httpTransport carries every HTTP request: to AWS, webhooks and the
+// preflight URL
+var httpTransport http.RoundTripper = newTransport()
+
+// newTransport returns a transport set up like http.DefaultTransport
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// networkFlags adds the network flags to another command's flags
+func networkFlags(fs *flag.FlagSet) {
+	for _, name := range networkFlagNames {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, name, f.Usage)
+	}
+}
+
+// setupNetwork combines the network flags with the config, the flags taking
+// precedence, and builds the HTTP transport from them
+func setupNetwork(cfg NetworkConfig) error {
+	if *ecsEndpoint != "" {
+		cfg.ECSEndpoint = *ecsEndpoint
+	}
+	if *stsEndpoint != "" {
+		cfg.STSEndpoint = *stsEndpoint
+	}
+	if *httpsProxy != "" {
+		cfg.HTTPSProxy = *httpsProxy
+	}
+	if *caBundle != "" {
+		cfg.CABundle = *caBundle
+	}
+	if *maxRetries >= 0 {
+		cfg.MaxRetries = maxRetries
+	}
+
+	for _, endpoint := range []string{cfg.ECSEndpoint, cfg.STSEndpoint} {
+		if u, err := url.Parse(endpoint); endpoint != "" && (err != nil || u.Scheme == "" || u.Host == "") {
+			return fmt.Errorf("invalid endpoint %s", endpoint)
+		}
+	}
+
+	transport := newTransport()
+	if cfg.HTTPSProxy != "" {
+		proxy, err := url.Parse(cfg.HTTPSProxy)
+		if err != nil || proxy.Host == "" {
+			return fmt.Errorf("invalid HTTPS proxy %s", cfg.HTTPSProxy)
+		}
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if req.URL.Scheme == "https" {
+				return proxy, nil
+			}
+			return http.ProxyFromEnvironment(req)
+		}
+	}
+	if cfg.CABundle != "" {
+		pem, err := ioutil.ReadFile(cfg.CABundle)
+		if err != nil {
+			return fmt.Errorf("unable to read CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA bundle %s", cfg.CABundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	network, httpTransport = cfg, transport
+	return nil
+}
+
+// awsConfig applies the network settings to the config of an AWS session
+func (n NetworkConfig) awsConfig(cfg *aws.Config) *aws.Config {
+	cfg.HTTPClient = &http.Client{Transport: httpTransport}
+	if n.MaxRetries != nil {
+		cfg.MaxRetries = aws.Int(*n.MaxRetries)
+	}
+
+	overrides := map[string]string{ecs.EndpointsID: n.ECSEndpoint, sts.EndpointsID: n.STSEndpoint}
+	cfg.EndpointResolver = endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if endpoint := overrides[service]; endpoint != "" {
+			return endpoints.ResolvedEndpoint{URL: endpoint, SigningRegion: region, SigningName: service}, nil
+		}
+		return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	})
+	return cfg
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Notifier types accepted in the config file
+const (
+	notifierSlack   = "slack"
+	notifierTeams   = "teams"
+	notifierDiscord = "discord"
+	notifierWebhook = "webhook"
+)
+
+// Kinds of event
+const (
+	eventStart      = "start"
+	eventSuccess    = "success"
+	eventRolledBack = "rolled_back"
+	eventFailure    = "failure"
+)
+
+// event is what notifiers are told about, at the end of a deploy and with
+// -notify-start when it begins
+type event struct {
+	Kind string `json:"kind"`
+	// Message is the Slack formatted summary of the deploy
+	Message string `json:"message"`
+	Success bool   `json:"success"`
+	// Result is the same document written with -output json, so far
+	Result *result `json:"result"`
+}
+
+// newEvent describes the end of a deploy that returned err
+func newEvent(message string, err error) *event {
+	e := &event{Kind: eventSuccess, Message: message, Success: err == nil, Result: runResult}
+	switch {
+	case err == nil:
+	case errorCategory(err) == categoryRolledBack:
+		e.Kind = eventRolledBack
+	default:
+		e.Kind = eventFailure
+	}
+	return e
+}
+
+// notifier sends deploy events somewhere
+type notifier interface {
+	// Name identifies the notifier in the deploy result
+	Name() string
+	Notify(ctx context.Context, e *event) error
+}
+
+// teamsNotifier posts a connector card to a Microsoft Teams incoming webhook
+type teamsNotifier struct {
+	url string
+}
+
+type teamsMessageCard struct {
+	Type       string `json:"@type"`
+	Context    string `json:"@context"`
+	Summary    string `json:"summary"`
+	ThemeColor string `json:"themeColor"`
+	Title      string `json:"title"`
+	Text       string `json:"text"`
+}
+
+func (n *teamsNotifier) Name() string {
+	return notifierTeams
+}
+
+func (n *teamsNotifier) Notify(ctx context.Context, e *event) error {
+	card := teamsMessageCard{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		Summary:    eventTitle(e),
+		ThemeColor: strings.TrimPrefix(eventColours[e.Kind], "#"),
+		Title:      eventTitle(e),
+		// Teams only honours line breaks written as markdown paragraphs
+		Text: strings.Replace(markdown(e.Message), "\n", "\n\n", -1),
+	}
+	return postJSON(ctx, n.url, card)
+}
+
+// discordNotifier posts to a Discord webhook
+type discordNotifier struct {
+	url string
+}
+
+// discordMaxContent is the longest message, in characters, Discord accepts
+const discordMaxContent = 2000
+
+type discordMessage struct {
+	Content  string `json:"content"`
+	Username string `json:"username"`
+}
+
+func (n *discordNotifier) Name() string {
+	return notifierDiscord
+}
+
+func (n *discordNotifier) Notify(ctx context.Context, e *event) error {
+	content := truncate(markdown(e.Message), discordMaxContent)
+	return postJSON(ctx, n.url, discordMessage{Content: content, Username: "GO ECS Deploy"})
+}
+
+// truncate shortens s to at most max characters, ending it with "..." if
+// anything was cut
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max-3]) + "..."
+}
+
+// webhookNotifier posts the whole deploy event as JSON, for other tooling
+type webhookNotifier struct {
+	url string
+}
+
+func (n *webhookNotifier) Name() string {
+	return notifierWebhook
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, e *event) error {
+	return postJSON(ctx, n.url, e)
+}
+
+// eventColours are the colours events are shown in, where supported
+var eventColours = map[string]string{
+	eventStart:      "#439FE0",
+	eventSuccess:    "#2EB67D",
+	eventRolledBack: "#ECB22E",
+	eventFailure:    "#E01E5A",
+}
+
+// eventTitle is a one line description of the event
+func eventTitle(e *event) string {
+	switch e.Kind {
+	case eventStart:
+		return fmt.Sprintf("Deploying %s to %s", apps, *environment)
+	case eventRolledBack:
+		return fmt.Sprintf("Rolled back deployment of %s to %s", apps, *environment)
+	case eventFailure:
+		return fmt.Sprintf("Failed deployment of %s to %s", apps, *environment)
+	}
+	return fmt.Sprintf("Deployed %s to %s", apps, *environment)
+}
+
+var (
+	slackBold = regexp.MustCompile(`\*([^*\n]+)\*`)
+	slackLink = regexp.MustCompile(`<([^|>]+)\|([^>]+)>`)
+)
+
+// markdown converts the Slack mrkdwn used in messages to common markdown
+func markdown(message string) string {
+	message = slackBold.ReplaceAllString(message, "**$1**")
+	return slackLink.ReplaceAllString(message, "[$2]($1)")
+}
+
+// notifiers builds the notifiers configured with flags and in the config file
+func notifiers(config *Config, envConfig EnvironmentConfig) ([]notifier, error) {
+	var ns []notifier
+	if *webhook != "" {
+		ns = append(ns, &slackNotifier{url: *webhook, channels: channels, format: *slackFormat})
+	}
+	if *teamsWebhook != "" {
+		ns = append(ns, &teamsNotifier{url: *teamsWebhook})
+	}
+	if *discordWebhook != "" {
+		ns = append(ns, &discordNotifier{url: *discordWebhook})
+	}
+	for _, url := range eventWebhooks {
+		ns = append(ns, &webhookNotifier{url: url})
+	}
+
+	for _, c := range append(config.Notifiers, envConfig.Notifiers...) {
+		if c.URL == "" {
+			return nil, fmt.Errorf("no url for %s notifier", c.Type)
+		}
+		switch c.Type {
+		case notifierSlack:
+			format := c.Format
+			if format == "" {
+				format = *slackFormat
+			}
+			if format != slackFormatRich && format != slackFormatPlain {
+				return nil, fmt.Errorf("unknown slack format %s", format)
+			}
+			ns = append(ns, &slackNotifier{url: c.URL, channels: c.Channels, format: format})
+		case notifierTeams:
+			ns = append(ns, &teamsNotifier{url: c.URL})
+		case notifierDiscord:
+			ns = append(ns, &discordNotifier{url: c.URL})
+		case notifierWebhook:
+			ns = append(ns, &webhookNotifier{url: c.URL})
+		default:
+			return nil, fmt.Errorf("unknown notifier type %s", c.Type)
+		}
+	}
+	return ns, nil
+}
+
+// configuredNotifiers are the notifiers sent to at the end of the run
+var configuredNotifiers []notifier
+
+// notify tells every notifier about the event. Notifiers that fail are
+// warned about and the first failure returned, but the rest still run.
+func notify(ctx context.Context, e *event) error {
+	if callerARN != "" {
+		e.Message += " (as `" + callerARN + "`)"
+	}
+
+	var first error
+	for _, n := range configuredNotifiers {
+		notifyCtx, s := startSpan(ctx, "notify "+n.Name(), "event", e.Kind)
+		err := n.Notify(notifyCtx, e)
+		s.finish(err)
+		recordNotification(n.Name(), err)
+		if err != nil {
+			fmt.Fprintf(progress, "Warning: unable to notify %s: %v \n", n.Name(), err)
+			if first == nil {
+				first = fmt.Errorf("unable to notify %s: %v", n.Name(), err)
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		max  int
+		want string
+	}{
+		{name: "short", s: "deployed", max: 10, want: "deployed"},
+		{name: "exactly max", s: "deployed", max: 8, want: "deployed"},
+		{name: "long", s: "deployed web", max: 10, want: "deploye..."},
+		{name: "multibyte", s: "déployé à prod", max: 10, want: "déployé..."},
+		{name: "emoji", s: strings.Repeat("🚀", 5), max: 4, want: "🚀..."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncate(tt.s, tt.max); got != tt.want {
+				t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.max, got, tt.want)
+			}
+		})
+	}
+}
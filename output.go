@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vend/go-ecs-deploy/ecsdeploy"
+)
+
+// Values for -output
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// result is the document written to stdout with -output json, describing what
+// the deploy was asked to do and what it did.
+type result struct {
+	DeployID      string               `json:"deploy_id"`
+	Caller        string               `json:"caller,omitempty"`
+	Inputs        resultInputs         `json:"inputs"`
+	Success       bool                 `json:"success"`
+	StartedAt     time.Time            `json:"started_at"`
+	FinishedAt    time.Time            `json:"finished_at"`
+	Targets       []targetResult       `json:"targets"`
+	Notifications []notificationResult `json:"notifications"`
+	Error         *errorResult         `json:"error,omitempty"`
+
+	mu sync.Mutex
+}
+
+type resultInputs struct {
+	Apps        []string `json:"apps"`
+	Environment string   `json:"environment"`
+	Regions     []string `json:"regions"`
+	Clusters    []string `json:"clusters"`
+	Repo        string   `json:"repo,omitempty"`
+	SHA         string   `json:"sha,omitempty"`
+	TargetImage string   `json:"target_image,omitempty"`
+	Version     string   `json:"version,omitempty"`
+}
+
+// targetResult is the outcome in one cluster of one region
+type targetResult struct {
+	Region                    string                    `json:"region"`
+	Cluster                   string                    `json:"cluster"`
+	Status                    string                    `json:"status"`
+	TaskDefinitionARN         string                    `json:"task_definition_arn,omitempty"`
+	PreviousTaskDefinitionARN string                    `json:"previous_task_definition_arn,omitempty"`
+	Image                     string                    `json:"image,omitempty"`
+	PreviousImage             string                    `json:"previous_image,omitempty"`
+	DiffURL                   string                    `json:"diff_url,omitempty"`
+	Changelog                 []commit                  `json:"changelog,omitempty"`
+	Tickets                   []string                  `json:"tickets,omitempty"`
+	Services                  []ecsdeploy.ServiceResult `json:"services"`
+	Error                     *errorResult              `json:"error,omitempty"`
+}
+
+type notificationResult struct {
+	Notifier string `json:"notifier"`
+	Sent     bool   `json:"sent"`
+	Error    string `json:"error,omitempty"`
+}
+
+type errorResult struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// progress is where progress output goes. With -output json it moves to
+// stderr, leaving stdout to the result document.
+var progress io.Writer = os.Stdout
+
+// runResult collects the outcome of this run as it goes
+var runResult = &result{StartedAt: time.Now().UTC()}
+
+func newErrorResult(err error) *errorResult {
+	if err == nil {
+		return nil
+	}
+	return &errorResult{Category: errorCategory(err), Message: err.Error()}
+}
+
+// recordNotification notes a notification that was, or failed to be, sent
+func recordNotification(notifier string, err error) {
+	n := notificationResult{Notifier: notifier, Sent: err == nil}
+	if err != nil {
+		n.Error = err.Error()
+	}
+
+	runResult.mu.Lock()
+	runResult.Notifications = append(runResult.Notifications, n)
+	runResult.mu.Unlock()
+}
+
+// recordOutcomes fills in the per-target results
+func recordOutcomes(outcomes []*outcome) {
+	for _, o := range outcomes {
+		runResult.Targets = append(runResult.Targets, targetResult{
+			Region:                    o.Region,
+			Cluster:                   o.Cluster,
+			Status:                    o.Status,
+			TaskDefinitionARN:         o.TaskDefinitionARN,
+			PreviousTaskDefinitionARN: o.PreviousTaskDefinitionARN,
+			Image:                     o.Image,
+			PreviousImage:             o.PreviousImage,
+			DiffURL:                   o.diffURL,
+			Changelog:                 o.changelog,
+			Tickets:                   ticketKeys(o.changelog),
+			Services:                  o.Services,
+			Error:                     newErrorResult(o.Err),
+		})
+	}
+}
+
+// finishResult fills in the rest of the result once the deploy is over
+func finishResult(err error) {
+	runResult.Caller = callerARN
+	runResult.DeployID = deployID
+	runResult.Inputs = resultInputs{
+		Apps:        apps,
+		Environment: *environment,
+		Regions:     regions,
+		Clusters:    clusters,
+		Repo:        *repoName,
+		SHA:         *sha,
+		TargetImage: *targetImage,
+		Version:     *appVersion,
+	}
+	runResult.FinishedAt = time.Now().UTC()
+	runResult.Success = err == nil
+	runResult.Error = newErrorResult(err)
+	if runResult.Targets == nil {
+		runResult.Targets = []targetResult{}
+	}
+	if runResult.Notifications == nil {
+		runResult.Notifications = []notificationResult{}
+	}
+}
+
+// writeResult prints the result document with -output json
+func writeResult() {
+	if *output != outputJSON {
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(runResult)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Kinds of repository host, which differ in how compare URLs are built
+const (
+	repoGitHub    = "github"
+	repoGitLab    = "gitlab"
+	repoBitbucket = "bitbucket"
+)
+
+// repository is the source repository being deployed
+type repository struct {
+	kind string
+	// baseURL is the web root of the host, e.g. https://github.com
+	baseURL string
+	// path is the repository path on the host, e.g. vend/go-ecs-deploy
+	path string
+}
+
+// compareURL links to the changes between two commits
+func (r *repository) compareURL(startSHA string, endSHA string) string {
+	switch r.kind {
+	case repoGitLab:
+		return r.baseURL + "/" + r.path + "/-/compare/" + startSHA + "..." + endSHA
+	case repoBitbucket:
+		return r.baseURL + "/" + r.path + "/branches/compare/" + endSHA + "%0D" + startSHA
+	}
+	return r.baseURL + "/" + r.path + "/compare/" + startSHA + "..." + endSHA
+}
+
+var (
+	detectedRepo    *repository
+	detectedRepoErr error
+	detectRepoOnce  sync.Once
+)
+
+// detectRepository works out the repository from -repo-url, the environment
+// of the CI provider running us, or failing those the local git remote.
+func detectRepository() (*repository, error) {
+	detectRepoOnce.Do(func() {
+		detectedRepo, detectedRepoErr = findRepository()
+		if detectedRepo != nil && *repoType != "" {
+			detectedRepo.kind = *repoType
+		}
+	})
+	return detectedRepo, detectedRepoErr
+}
+
+func findRepository() (*repository, error) {
+	if *repoURL != "" {
+		return parseRepoURL(*repoURL)
+	}
+
+	// GitHub Actions
+	if slug := os.Getenv("GITHUB_REPOSITORY"); slug != "" {
+		server := os.Getenv("GITHUB_SERVER_URL")
+		if server == "" {
+			server = "https://github.com"
+		}
+		return &repository{kind: repoGitHub, baseURL: strings.TrimSuffix(server, "/"), path: slug}, nil
+	}
+
+	// GitLab CI, which may well be self-hosted without "gitlab" in the name
+	if project := os.Getenv("CI_PROJECT_URL"); project != "" {
+		r, err := parseRepoURL(project)
+		if err == nil {
+			r.kind = repoGitLab
+		}
+		return r, err
+	}
+
+	// Bitbucket Pipelines
+	if slug := os.Getenv("BITBUCKET_REPO_FULL_NAME"); slug != "" {
+		return &repository{kind: repoBitbucket, baseURL: "https://bitbucket.org", path: slug}, nil
+	}
+
+	// CircleCI, Buildkite
+	for _, name := range []string{"CIRCLE_REPOSITORY_URL", "BUILDKITE_REPO"} {
+		if remote := os.Getenv(name); remote != "" {
+			return parseRepoURL(remote)
+		}
+	}
+
+	// Travis
+	if slug := os.Getenv("TRAVIS_REPO_SLUG"); slug != "" {
+		return &repository{kind: repoGitHub, baseURL: "https://github.com", path: slug}, nil
+	}
+
+	out, err := exec.Command("git", "config", "--get", "remote.origin.url").Output()
+	if err != nil {
+		return nil, errors.New("unable to detect the repository, use -repo-url")
+	}
+	return parseRepoURL(strings.TrimSpace(string(out)))
+}
+
+// parseRepoURL understands web URLs and the https and ssh remotes git uses:
+//
+//	https://github.com/vend/go-ecs-deploy
+//	https://github.com/vend/go-ecs-deploy.git
+//	git@github.com:vend/go-ecs-deploy.git
+//	ssh://git@github.com/vend/go-ecs-deploy.git
+func parseRepoURL(raw string) (*repository, error) {
+	// scp-like ssh remotes have no scheme
+	if !strings.Contains(raw, "://") {
+		if at := strings.Index(raw, "@"); at >= 0 {
+			raw = "ssh://" + strings.Replace(raw[at+1:], ":", "/", 1)
+		} else {
+			raw = "https://" + raw
+		}
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse repository %s: %v", raw, err)
+	}
+
+	path := strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	if u.Host == "" || path == "" {
+		return nil, fmt.Errorf("unable to parse repository %s", raw)
+	}
+
+	r := &repository{kind: repoGitHub, baseURL: "https://" + u.Hostname(), path: path}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		// keep the port of web URLs, which ssh remotes can't tell us
+		r.baseURL = u.Scheme + "://" + u.Host
+	}
+
+	switch host := strings.ToLower(u.Hostname()); {
+	case strings.Contains(host, "gitlab"):
+		r.kind = repoGitLab
+	case strings.Contains(host, "bitbucket"):
+		r.kind = repoBitbucket
+	}
+	return r, nil
+}
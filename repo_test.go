@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRepoURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    *repository
+		wantErr bool
+	}{
+		{raw: "https://github.com/vend/go-ecs-deploy", want: &repository{repoGitHub, "https://github.com", "vend/go-ecs-deploy"}},
+		{raw: "https://github.com/vend/go-ecs-deploy.git", want: &repository{repoGitHub, "https://github.com", "vend/go-ecs-deploy"}},
+		{raw: "github.com/vend/go-ecs-deploy/", want: &repository{repoGitHub, "https://github.com", "vend/go-ecs-deploy"}},
+		{raw: "git@github.com:vend/go-ecs-deploy.git", want: &repository{repoGitHub, "https://github.com", "vend/go-ecs-deploy"}},
+		{raw: "ssh://git@github.com/vend/go-ecs-deploy.git", want: &repository{repoGitHub, "https://github.com", "vend/go-ecs-deploy"}},
+		{raw: "ssh://git@gitlab.example.com:2222/group/sub/project.git", want: &repository{repoGitLab, "https://gitlab.example.com", "group/sub/project"}},
+		{raw: "https://gitlab.example.com:8443/group/project", want: &repository{repoGitLab, "https://gitlab.example.com:8443", "group/project"}},
+		{raw: "http://git.example.com/team/app", want: &repository{repoGitHub, "http://git.example.com", "team/app"}},
+		{raw: "git@bitbucket.org:vend/app.git", want: &repository{repoBitbucket, "https://bitbucket.org", "vend/app"}},
+		{raw: "https://github.com/", wantErr: true},
+		{raw: "git@github.com:", wantErr: true},
+		{raw: "https://github.com:port/vend/app", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRepoURL(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRepoURL(%q) error = %v, want error %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRepoURL(%q) = %+v, want %+v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestCompareURL(t *testing.T) {
+	tests := []struct {
+		repo *repository
+		want string
+	}{
+		{&repository{repoGitHub, "https://github.com", "vend/app"}, "https://github.com/vend/app/compare/abc1234...def5678"},
+		{&repository{repoGitLab, "https://gitlab.example.com", "group/app"}, "https://gitlab.example.com/group/app/-/compare/abc1234...def5678"},
+		{&repository{repoBitbucket, "https://bitbucket.org", "vend/app"}, "https://bitbucket.org/vend/app/branches/compare/def5678%0Dabc1234"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.repo.compareURL("abc1234", "def5678"); got != tt.want {
+			t.Errorf("compareURL() on %s = %s, want %s", tt.repo.kind, got, tt.want)
+		}
+	}
+}
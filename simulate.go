@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/vend/go-ecs-deploy/ecsdeploy"
+)
+
+// simulatedECS returns an in-memory ECS for each region, all seeded from the
+// -simulate fixture
+func simulatedECS(fixture *ecsdeploy.Fixture) (func(region string) ecsdeploy.ECSAPI, error) {
+	simulators := map[string]*ecsdeploy.Simulator{}
+	for _, region := range regions {
+		sim, err := ecsdeploy.NewSimulator(region, fixture)
+		if err != nil {
+			return nil, fmt.Errorf("unable to simulate %s: %v", region, err)
+		}
+		simulators[region] = sim
+	}
+
+	return func(region string) ecsdeploy.ECSAPI {
+		return simulators[region]
+	}, nil
+}
+
+// simulatedIdentity is the account and ARN a simulated deploy runs as
+func simulatedIdentity(fixture *ecsdeploy.Fixture) (string, string) {
+	account := fixture.AccountID
+	if account == "" {
+		account = ecsdeploy.DefaultSimulatedAccountID
+	}
+
+	arn := fixture.CallerARN
+	if arn == "" {
+		arn = fmt.Sprintf("arn:aws:iam::%s:user/go-ecs-deploy", account)
+	}
+	return account, arn
+}
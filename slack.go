@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vend/go-ecs-deploy/ecsdeploy"
+)
+
+// Slack message formats
+const (
+	slackFormatRich  = "rich"
+	slackFormatPlain = "plain"
+)
+
+// slackNotifier posts to a Slack incoming webhook, once per channel
+type slackNotifier struct {
+	url      string
+	channels []string
+	format   string
+}
+
+type SlackMessage struct {
+	Text        string            `json:"text,omitempty"`
+	Username    string            `json:"username"`
+	Channel     *string           `json:"channel,omitempty"`
+	Attachments []SlackAttachment `json:"attachments,omitempty"`
+}
+
+// SlackAttachment is a colour coded block of fields in a Slack message
+type SlackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Title    string       `json:"title,omitempty"`
+	Text     string       `json:"text,omitempty"`
+	Fields   []SlackField `json:"fields,omitempty"`
+	MrkdwnIn []string     `json:"mrkdwn_in,omitempty"`
+}
+
+type SlackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func (n *slackNotifier) Name() string {
+	return notifierSlack
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, e *event) error {
+	message := SlackMessage{Text: e.Message}
+	if n.format == slackFormatRich {
+		message = SlackMessage{Attachments: slackAttachments(e)}
+	}
+	message.Username = "GO ECS Deploy"
+
+	if len(n.channels) == 0 {
+		return postJSON(ctx, n.url, message)
+	}
+
+	var failed []string
+	for _, channel := range n.channels {
+		channel := channel
+		message.Channel = &channel
+		if err := postJSON(ctx, n.url, message); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", channel, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to notify %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// slackAttachments lays the event out as one attachment per region and
+// cluster, falling back to a single attachment before anything was deployed
+// or when the deploy never got that far.
+func slackAttachments(e *event) []SlackAttachment {
+	colour := eventColours[e.Kind]
+	title := eventTitle(e)
+
+	var duration string
+	if e.Kind != eventStart && !e.Result.FinishedAt.IsZero() {
+		duration = e.Result.FinishedAt.Sub(e.Result.StartedAt).Round(time.Second).String()
+	}
+
+	common := func(fields []SlackField) []SlackField {
+		fields = appendField(fields, "Environment", *environment, true)
+		fields = appendField(fields, "Version", *appVersion, true)
+		fields = appendField(fields, "Duration", duration, true)
+		return appendField(fields, "Deployer", callerARN, false)
+	}
+
+	if len(e.Result.Targets) == 0 {
+		var fields []SlackField
+		fields = appendField(fields, "Apps", strings.Join(apps, ", "), true)
+		fields = appendField(fields, "Clusters", strings.Join(clusters, ", "), true)
+		fields = appendField(fields, "Image", requestedImage(), false)
+		return []SlackAttachment{{
+			Fallback: e.Message,
+			Color:    colour,
+			Title:    title,
+			Text:     errorText(e),
+			Fields:   common(fields),
+			MrkdwnIn: []string{"text", "fields"},
+		}}
+	}
+
+	var attachments []SlackAttachment
+	for i, t := range e.Result.Targets {
+		targetColour := colour
+		switch t.Status {
+		case ecsdeploy.StatusFailed, ecsdeploy.StatusSkipped:
+			targetColour = eventColours[eventFailure]
+		case ecsdeploy.StatusRolledBack:
+			targetColour = eventColours[eventRolledBack]
+		case ecsdeploy.StatusDeployed:
+			targetColour = eventColours[eventSuccess]
+		}
+
+		var services []string
+		for _, s := range t.Services {
+			services = append(services, s.Name)
+		}
+
+		var fields []SlackField
+		fields = appendField(fields, "Apps", strings.Join(services, ", "), true)
+		fields = appendField(fields, "Cluster", t.Cluster, true)
+		fields = appendField(fields, "Region", t.Region, true)
+		fields = appendField(fields, "Status", t.Status, true)
+		fields = appendField(fields, "Image", t.Image, false)
+		fields = appendField(fields, "Previous image", t.PreviousImage, false)
+		if t.DiffURL != "" {
+			fields = appendField(fields, "Diff", "<"+t.DiffURL+"|compare>", true)
+		}
+		if len(t.Changelog) > 0 {
+			fields = appendField(fields, "Changes", formatChangelog(t.Changelog, *changelogSize), false)
+		}
+
+		a := SlackAttachment{
+			Fallback: e.Message,
+			Color:    targetColour,
+			Fields:   fields,
+			MrkdwnIn: []string{"text", "fields"},
+		}
+		if t.Error != nil {
+			a.Text = t.Error.Message
+		}
+		if i == 0 {
+			a.Title = title
+		}
+		if i == len(e.Result.Targets)-1 {
+			a.Fields = common(a.Fields)
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments
+}
+
+func appendField(fields []SlackField, title string, value string, short bool) []SlackField {
+	if value == "" {
+		return fields
+	}
+	return append(fields, SlackField{Title: title, Value: value, Short: short})
+}
+
+// errorText is the error shown for a deploy that failed before any target
+func errorText(e *event) string {
+	if e.Result.Error == nil {
+		return ""
+	}
+	return e.Result.Error.Message
+}
+
+// requestedImage is the image asked for on the command line
+func requestedImage() string {
+	if *targetImage != "" {
+		return *targetImage
+	}
+	if *repoName != "" && *sha != "" {
+		return *repoName + ":" + *sha
+	}
+	return *sha
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vend/go-ecs-deploy/ecsdeploy"
+)
+
+// logger prefixes progress output so that concurrent deploys stay readable
+type logger struct {
+	prefix string
+}
+
+func (l logger) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(progress, l.prefix+format, args...)
+}
+
+// label names the target in output and notifications. Only the parts that
+// vary between targets are included, so a single target has no label.
+func label(t ecsdeploy.Target, ts []ecsdeploy.Target) string {
+	var regionVaries, clusterVaries bool
+	for _, other := range ts {
+		regionVaries = regionVaries || other.Region != t.Region
+		clusterVaries = clusterVaries || other.Cluster != t.Cluster
+	}
+
+	switch {
+	case regionVaries && clusterVaries:
+		return t.Region + "/" + t.Cluster
+	case regionVaries:
+		return t.Region
+	case clusterVaries:
+		return t.Cluster
+	}
+	return ""
+}
+
+// targetLogger prefixes output about a target with its label
+func targetLogger(t ecsdeploy.Target, ts []ecsdeploy.Target) logger {
+	if l := label(t, ts); l != "" {
+		return logger{prefix: "[" + l + "] "}
+	}
+	return logger{}
+}
+
+// printEvent prints the progress of a deploy to targets ts
+func printEvent(ts []ecsdeploy.Target) func(ecsdeploy.Event) {
+	return func(e ecsdeploy.Event) {
+		log := targetLogger(e.Target, ts)
+		if e.Service != "" {
+			log.prefix += "[" + e.Service + "] "
+		}
+		log.Printf("%s \n", e.Message)
+	}
+}
+
+// outcome is the result of the deploy to one target, along with the changes
+// it shipped
+type outcome struct {
+	*ecsdeploy.TargetResult
+
+	previousSHA string
+	diffURL     string
+	// changelog lists the commits between previousSHA and the deployed sha
+	changelog []commit
+}
+
+// describeChanges links each target's result to the changes it shipped: a
+// diff between the previously deployed sha and the new one and, with
+// -changelog, the commits in between.
+func describeChanges(results []*ecsdeploy.TargetResult, ts []ecsdeploy.Target) []*outcome {
+	outcomes := make([]*outcome, len(results))
+	for i, r := range results {
+		o := &outcome{TargetResult: r}
+		outcomes[i] = o
+
+		// extract old image sha, and use it to generate a git compare URL
+		if r.PreviousImage != "" && *sha != "" {
+			parts := strings.Split(r.PreviousImage, ":")
+			if len(parts) == 2 {
+				// possibly a tagged image "def15c31-php5.5"
+				parts = strings.Split(parts[1], "-")
+				o.previousSHA = parts[0]
+				if gitURL, err := gitURL(parts[0], *sha); err == nil {
+					o.diffURL = gitURL
+				}
+			}
+		}
+
+		if r.Status == ecsdeploy.StatusDeployed && *changelogSize > 0 && o.previousSHA != "" && o.previousSHA != *sha {
+			if commits, err := changelog(o.previousSHA, *sha); err != nil {
+				targetLogger(r.Target, ts).Printf("Unable to list changes since %s: %v \n", o.previousSHA, err)
+			} else {
+				o.changelog = commits
+			}
+		}
+	}
+	return outcomes
+}
+
+// messages are the notification lines for a target that deployed
+func (o *outcome) messages() []string {
+	var appDisplayVersion string
+	if *appVersion != "" {
+		appDisplayVersion = fmt.Sprintf(" (version %s)", *appVersion)
+	}
+
+	var diffLink string
+	if o.diffURL != "" {
+		diffLink = " (<" + o.diffURL + "|diff>)"
+	}
+
+	var messages []string
+	for _, s := range o.Services {
+		if s.Status != ecsdeploy.StatusDeployed {
+			continue
+		}
+		var live string
+		if s.LiveColour != "" {
+			live = fmt.Sprintf(", *%s* is now live", s.LiveColour)
+		}
+		messages = append(messages, fmt.Sprintf("Deployed %s for *%s%s* to *%s* as `%s`%s%s", o.Image, s.App, appDisplayVersion, o.Cluster, o.TaskDefinitionARN, live, diffLink))
+	}
+
+	if len(o.changelog) > 0 {
+		messages = append(messages, formatChangelog(o.changelog, *changelogSize))
+	}
+	return messages
+}
+
+// summary builds the single notification sent for a deploy, labelling each
+// line with its target when there is more than one, and reports whether every
+// target succeeded.
+func summary(outcomes []*outcome, ts []ecsdeploy.Target) (string, bool) {
+	var lines []string
+	ok := true
+
+	for i, o := range outcomes {
+		line := func(msg string) {
+			if label := label(ts[i], ts); label != "" {
+				msg = fmt.Sprintf("*%s*: %s", label, msg)
+			}
+			lines = append(lines, msg)
+		}
+
+		switch {
+		case o.Status == ecsdeploy.StatusSkipped:
+			ok = false
+			line("skipped")
+		case o.Err != nil:
+			ok = false
+			msg := o.Err.Error()
+			if o.RolledBack {
+				msg += "\nRolled back"
+			}
+			line(msg)
+		case o.RolledBack:
+			line("rolled back")
+		default:
+			for _, msg := range o.messages() {
+				line(msg)
+			}
+		}
+	}
+
+	return strings.Join(lines, "\n"), ok
+}
+
+// failureCategory is the category reported for a deploy where some target
+// failed: rolled back if anything was, otherwise that of the first failure.
+func failureCategory(outcomes []*outcome) string {
+	for _, o := range outcomes {
+		if o.RolledBack {
+			return categoryRolledBack
+		}
+	}
+	for _, o := range outcomes {
+		if o.Err != nil {
+			return errorCategory(o.Err)
+		}
+	}
+	return categoryAborted
+}
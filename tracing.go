@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+// traceExportTimeout bounds how long exporting the trace can hold up exit
+const traceExportTimeout = 10 * time.Second
+
+// span is one timed operation in the trace of a run
+type span struct {
+	traceID  [16]byte
+	id       [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+// tracer collects the spans of a run and exports them over OTLP/HTTP once it
+// is over, so that tracing adds no requests to the deploy itself.
+type tracer struct {
+	mu       sync.Mutex
+	endpoint string
+	headers  map[string]string
+	remote   *span
+	root     *span
+	spans    []*span
+}
+
+// traces is set with -otlp-endpoint. While it's nil no spans are recorded.
+var traces *tracer
+
+type spanKey struct{}
+type awsSpanKey struct{}
+
+// newTracer exports to the OTLP/HTTP endpoint, e.g. http://localhost:4318.
+// A TRACEPARENT in the environment, as set by some CI systems, becomes the
+// parent of the run.
+func newTracer(endpoint string) *tracer {
+	t := &tracer{endpoint: endpoint, headers: map[string]string{}}
+	if !strings.HasSuffix(t.endpoint, "/v1/traces") {
+		t.endpoint = strings.TrimSuffix(t.endpoint, "/") + "/v1/traces"
+	}
+
+	for _, header := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if parts := strings.SplitN(header, "=", 2); len(parts) == 2 {
+			t.headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	t.remote = parseTraceparent(os.Getenv("TRACEPARENT"))
+	return t
+}
+
+// parseTraceparent reads a W3C traceparent header, returning nil if it's not
+// valid
+func parseTraceparent(value string) *span {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	s := &span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(s.id[:], []byte(parts[2])); err != nil {
+		return nil
+	}
+	return s
+}
+
+// startSpan starts a span as a child of the one in ctx, or of the first span
+// started if ctx has none, returning a context holding the new span. attrs are
+// pairs of keys and values. Without tracing ctx is returned as is with a nil
+// span, whose methods do nothing.
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, *span) {
+	if traces == nil {
+		return ctx, nil
+	}
+
+	s := &span{name: name, kind: spanKindInternal, start: time.Now(), attrs: map[string]string{}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+	rand.Read(s.id[:])
+
+	traces.mu.Lock()
+	defer traces.mu.Unlock()
+
+	// Work done outside of any span, like refreshing credentials, still
+	// belongs to the run
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		parent = traces.root
+	}
+	if parent == nil {
+		parent = traces.remote
+	}
+	if parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.id
+	} else {
+		rand.Read(s.traceID[:])
+	}
+
+	if traces.root == nil {
+		traces.root = s
+	}
+	traces.spans = append(traces.spans, s)
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *span) set(key string, value string) {
+	if s == nil {
+		return
+	}
+	traces.mu.Lock()
+	s.attrs[key] = value
+	traces.mu.Unlock()
+}
+
+// finish ends the span, marking it failed if err isn't nil
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	traces.mu.Lock()
+	s.end, s.err = time.Now(), err
+	traces.mu.Unlock()
+}
+
+// traceparent is the W3C header continuing the trace from this span
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.id[:]) + "-01"
+}
+
+// instrumentSession records a client span for every AWS call made by the
+// clients created from sess, as a child of the span in the request's context.
+func instrumentSession(sess *session.Session) {
+	sess.Handlers.Validate.PushFrontNamed(request.NamedHandler{
+		Name: "goecsdeploy.StartSpan",
+		Fn: func(r *request.Request) {
+			ctx, s := startSpan(r.Context(), r.ClientInfo.ServiceName+"."+r.Operation.Name,
+				"rpc.system", "aws-api",
+				"rpc.service", r.ClientInfo.ServiceName,
+				"rpc.method", r.Operation.Name,
+				"cloud.region", aws.StringValue(r.Config.Region))
+			if s == nil {
+				return
+			}
+			s.kind = spanKindClient
+			r.SetContext(context.WithValue(ctx, awsSpanKey{}, s))
+		},
+	})
+	sess.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "goecsdeploy.FinishSpan",
+		Fn: func(r *request.Request) {
+			s, ok := r.Context().Value(awsSpanKey{}).(*span)
+			if !ok {
+				return
+			}
+			if r.HTTPResponse != nil {
+				s.set("http.status_code", strconv.Itoa(r.HTTPResponse.StatusCode))
+			}
+			s.set("aws.request_id", r.RequestID)
+			s.set("aws.retries", strconv.Itoa(r.RetryCount))
+			s.finish(r.Error)
+		},
+	})
+}
+
+// tracingTransport records a client span for every HTTP request and passes
+// the trace on to the server in a traceparent header. Only the host is
+// recorded, since webhook URLs embed their secret.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = httpTransport
+	}
+
+	_, s := startSpan(req.Context(), "HTTP "+req.Method, "http.method", req.Method, "net.peer.name", req.URL.Host)
+	if s == nil {
+		return base.RoundTrip(req)
+	}
+	s.kind = spanKindClient
+
+	// a RoundTripper mustn't modify the request, so the header goes on a copy
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for key, values := range req.Header {
+		r.Header[key] = values
+	}
+	r.Header.Set("traceparent", s.traceparent())
+	req = r
+
+	resp, err := base.RoundTrip(req)
+	if err == nil {
+		s.set("http.status_code", strconv.Itoa(resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			err = fmt.Errorf("received status [%s]", resp.Status)
+		}
+	}
+	s.finish(err)
+	return resp, err
+}
+
+// OTLP/HTTP JSON encoding of the spans
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func attribute(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+// exportTraces sends every span recorded to the collector. Spans still open,
+// e.g. cut short by a failure, end now.
+func exportTraces() error {
+	if traces == nil {
+		return nil
+	}
+
+	traces.mu.Lock()
+	var spans []otlpSpan
+	for _, s := range traces.spans {
+		if s.end.IsZero() {
+			s.end = time.Now()
+		}
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        []otlpAttribute{},
+			Status:            otlpStatus{Code: spanStatusOK},
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for key, value := range s.attrs {
+			o.Attributes = append(o.Attributes, attribute(key, value))
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: spanStatusError, Message: s.err.Error()}
+		}
+		spans = append(spans, o)
+	}
+	traces.mu.Unlock()
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "go-ecs-deploy"
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{attribute("service.name", serviceName)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "go-ecs-deploy"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", traces.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range traces.headers {
+		req.Header.Set(key, value)
+	}
+
+	// the export itself isn't traced
+	resp, err := (&http.Client{Transport: httpTransport, Timeout: traceExportTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("received status [%s]", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vend/go-ecs-deploy/ecsdeploy"
+)
+
+// deployWaves converts the waves configured for the environment
+func deployWaves(configured []Wave) ([]ecsdeploy.Wave, error) {
+	var waves []ecsdeploy.Wave
+	for n, c := range configured {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("%d", n+1)
+		}
+
+		if c.Percent < 0 || c.Percent > 100 {
+			return nil, fmt.Errorf("invalid percent for wave %s: %d, expected 1 to 100 or none", name, c.Percent)
+		}
+
+		w := ecsdeploy.Wave{Name: c.Name, Apps: c.Apps, Percent: c.Percent, Approve: c.Approve}
+		if c.Pause != "" {
+			pause, err := time.ParseDuration(c.Pause)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pause for wave %s: %v", name, err)
+			}
+			w.Pause = pause
+		}
+		waves = append(waves, w)
+	}
+	return waves, nil
+}
+
+// approvals serialises approval prompts from concurrent deployments
+var approvals sync.Mutex
+
+// lines reads r a line at a time as they're asked for. A single reader is
+// kept, so that whatever it buffers past one line is there for the next.
+type lines struct {
+	r    io.Reader
+	once sync.Once
+	c    chan string
+}
+
+// stdinLines are the answers to approval prompts
+var stdinLines = &lines{r: os.Stdin}
+
+// next returns the next line, or false at the end of the input or once ctx is
+// done
+func (l *lines) next(ctx context.Context) (string, bool) {
+	l.once.Do(func() {
+		l.c = make(chan string)
+		go func() {
+			br := bufio.NewReader(l.r)
+			for {
+				line, err := br.ReadString('\n')
+				if line != "" {
+					l.c <- line
+				}
+				if err != nil {
+					close(l.c)
+					return
+				}
+			}
+		}()
+	})
+
+	select {
+	case <-ctx.Done():
+		return "", false
+	case line, ok := <-l.c:
+		return line, ok
+	}
+}
+
+// approveOnStdin asks whether to carry on with the next wave on stdin
+func approveOnStdin(ts []ecsdeploy.Target) func(context.Context, ecsdeploy.Target, string) bool {
+	return func(ctx context.Context, t ecsdeploy.Target, wave string) bool {
+		approvals.Lock()
+		defer approvals.Unlock()
+
+		targetLogger(t, ts).Printf("Wave %s is stable. Continue with the next wave? [y/N] ", wave)
+		answer, _ := stdinLines.next(ctx)
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true
+		}
+		return false
+	}
+}
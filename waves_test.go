@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vend/go-ecs-deploy/ecsdeploy"
+)
+
+func TestDeployWaves(t *testing.T) {
+	tests := []struct {
+		name    string
+		waves   []Wave
+		want    []ecsdeploy.Wave
+		wantErr string
+	}{
+		{
+			name:  "waves",
+			waves: []Wave{{Name: "canaries", Apps: []string{"web"}, Pause: "5m", Approve: true}, {Percent: 100}},
+			want:  []ecsdeploy.Wave{{Name: "canaries", Apps: []string{"web"}, Pause: 5 * time.Minute, Approve: true}, {Percent: 100}},
+		},
+		{name: "percent over 100", waves: []Wave{{Percent: 150}}, wantErr: "invalid percent for wave 1: 150"},
+		{name: "negative percent", waves: []Wave{{Name: "early", Percent: -1}}, wantErr: "invalid percent for wave early: -1"},
+		{name: "invalid pause", waves: []Wave{{Percent: 10}, {Pause: "soon"}}, wantErr: "invalid pause for wave 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := deployWaves(tt.waves)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("deployWaves() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("deployWaves() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Name != tt.want[i].Name || strings.Join(got[i].Apps, ",") != strings.Join(tt.want[i].Apps, ",") ||
+					got[i].Percent != tt.want[i].Percent || got[i].Pause != tt.want[i].Pause || got[i].Approve != tt.want[i].Approve {
+					t.Errorf("wave %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestApproveOnStdin(t *testing.T) {
+	defer func(l *lines, w io.Writer) { stdinLines, progress = l, w }(stdinLines, progress)
+	progress = ioutil.Discard
+	approve := approveOnStdin([]ecsdeploy.Target{{Region: "eu-west-1", Cluster: "vend-test"}})
+	target := ecsdeploy.Target{Region: "eu-west-1", Cluster: "vend-test"}
+
+	// answers piped in together are each kept for their own prompt
+	stdinLines = &lines{r: strings.NewReader("y\nno\n YES \n")}
+	for n, want := range []bool{true, false, true, false} {
+		if got := approve(context.Background(), target, "1"); got != want {
+			t.Errorf("answer %d approved = %v, want %v", n+1, got, want)
+		}
+	}
+
+	// a prompt nobody answers gives up with its context
+	r, w := io.Pipe()
+	defer w.Close()
+	stdinLines = &lines{r: r}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if approve(ctx, target, "1") {
+		t.Error("approved without an answer")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Backoff between webhook attempts doubles from webhookMinBackoff, and neither
+// it nor a Retry-After from the server may exceed webhookMaxBackoff
+const (
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = 30 * time.Second
+)
+
+// webhookClient is used for every notification. Each attempt is given
+// -webhook-timeout, so that a hung webhook can't hang the deploy.
+var webhookClient = &http.Client{Transport: &tracingTransport{}}
+
+// postJSON posts body as JSON to url, retrying up to -webhook-retries times
+// when the request fails outright, is rate limited or hits a server error.
+func postJSON(ctx context.Context, url string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("unable to encode notification: %v", err)
+	}
+
+	backoff := webhookMinBackoff
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		var retryAfter time.Duration
+		attemptCtx, cancel := context.WithTimeout(ctx, *webhookTimeout)
+		resp, err := webhookClient.Do(req.WithContext(attemptCtx))
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		if err == nil {
+			switch {
+			case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+				err = fmt.Errorf("received status [%s]", resp.Status)
+				retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			case resp.StatusCode < 200 || resp.StatusCode > 299:
+				// the request itself is wrong, retrying won't help
+				return fmt.Errorf("received status [%s]", resp.Status)
+			}
+		}
+
+		if err == nil {
+			return nil
+		}
+		if attempt >= *webhookRetries {
+			return fmt.Errorf("giving up after %d attempts: %v", attempt+1, err)
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		if wait > webhookMaxBackoff {
+			wait = webhookMaxBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("giving up after %d attempts: %v", attempt+1, err)
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as
+// an HTTP date, returning 0 if there is none.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
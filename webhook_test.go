@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		min, max time.Duration
+	}{
+		{name: "none"},
+		{name: "seconds", value: "5", min: 5 * time.Second, max: 5 * time.Second},
+		{name: "date", value: time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat), min: 28 * time.Second, max: 30 * time.Second},
+		{name: "past date", value: time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), min: -2 * time.Minute, max: 0},
+		{name: "invalid", value: "soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %s, want %s to %s", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestPostJSON(t *testing.T) {
+	defer func(retries int) { *webhookRetries = retries }(*webhookRetries)
+
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		attempts int
+		wantErr  bool
+	}{
+		{name: "delivered", statuses: []int{200}, retries: 3, attempts: 1},
+		{name: "server error", statuses: []int{503, 204}, retries: 3, attempts: 2},
+		{name: "rate limited", statuses: []int{429, 200}, retries: 3, attempts: 2},
+		{name: "bad request", statuses: []int{400, 200}, retries: 3, attempts: 1, wantErr: true},
+		{name: "gives up", statuses: []int{500, 500, 200}, retries: 1, attempts: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+					t.Errorf("Content-Type = %q, want application/json", ct)
+				}
+				status := tt.statuses[attempts]
+				attempts++
+				if status == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "1")
+				}
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			*webhookRetries = tt.retries
+			err := postJSON(context.Background(), srv.URL, map[string]string{"text": "deployed"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("postJSON() error = %v, want error %v", err, tt.wantErr)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts != tt.attempts {
+				t.Errorf("postJSON() made %d attempts, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestPostJSONTimeout(t *testing.T) {
+	defer func(retries int, timeout time.Duration) {
+		*webhookRetries, *webhookTimeout = retries, timeout
+	}(*webhookRetries, *webhookTimeout)
+	*webhookRetries, *webhookTimeout = 0, 50*time.Millisecond
+
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer srv.Close()
+	defer close(hung)
+
+	// notifiers post concurrently, so the timeout mustn't be set on the
+	// shared client
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := postJSON(context.Background(), srv.URL, map[string]string{"text": "deployed"}); err == nil {
+				t.Error("postJSON() to a hung webhook succeeded")
+			}
+		}()
+	}
+	wg.Wait()
+}